@@ -0,0 +1,103 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+)
+
+// runBuild runs the site build before a push, so what is deployed is never
+// stale. Without a buildcommand, hugo is run with sourceDir as its
+// destination. The build runs in the config file's directory, like the
+// paths in the config file are relative to it, or the current directory if
+// there is no config file. The build's output goes to the log, and all of
+// it is shown if the build fails.
+func runBuild(sourceDir string) error {
+	var c *exec.Cmd
+	command := viper.GetString("buildcommand")
+	if command == "" {
+		c = exec.Command("hugo", "--destination", sourceDir)
+		command = strings.Join(c.Args, " ")
+	} else {
+		c = shellCommand(command)
+	}
+	if cfg := viper.ConfigFileUsed(); cfg != "" {
+		c.Dir = filepath.Dir(cfg)
+	}
+	c.Env = append(os.Environ(), "HUGODEPLOY_SOURCEDIR="+sourceDir)
+
+	jww.FEEDBACK.Println("Building site: ", command)
+	var output bytes.Buffer
+	logged := &buildLog{}
+	c.Stdout = io.MultiWriter(&output, logged)
+	c.Stderr = c.Stdout
+	start := time.Now()
+	err := c.Run()
+	logged.flush()
+	if err != nil {
+		scanner := bufio.NewScanner(&output)
+		for scanner.Scan() {
+			jww.ERROR.Println("build: ", scanner.Text())
+		}
+		return fmt.Errorf("build command %q failed: %v. Fix the build or use --no-build to push what is already in %s", command, err, sourceDir)
+	}
+	jww.FEEDBACK.Println("Build finished in ", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// shellCommand runs command through the shell, so it can use pipes, && etc
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// buildLog logs each line of build output as it arrives
+type buildLog struct {
+	partial []byte
+}
+
+func (l *buildLog) Write(b []byte) (int, error) {
+	l.partial = append(l.partial, b...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		jww.INFO.Println("build: ", strings.TrimRight(string(l.partial[:i]), "\r"))
+		l.partial = l.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+func (l *buildLog) flush() {
+	if len(l.partial) > 0 {
+		jww.INFO.Println("build: ", string(l.partial))
+		l.partial = nil
+	}
+}
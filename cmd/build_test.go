@@ -0,0 +1,74 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mindok/hugodeploy/deploy/ftptest"
+)
+
+// TestBuildRunsInConfigDir pushes from a directory other than the site's
+// with a build command that writes a marker file, and checks the build ran
+// in the config file's directory, where the relative paths in the config
+// file point.
+func TestBuildRunsInConfigDir(t *testing.T) {
+	srv, err := ftptest.NewServer(ftptest.Quirks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if err := srv.Fs.MkdirAll("/www", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cfg := writeTestSite(t, dir, fmt.Sprintf(`deployer: ftp
+sourcedir: public
+deployrecorddir: deployed
+build: true
+buildcommand: echo built > built.txt
+ftp:
+  host: %s
+  port: %s
+  user: %s
+  pwd: %s
+  rootdir: /www
+`, srv.Host(), srv.Port(), srv.User, srv.Password))
+
+	elsewhere := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(elsewhere); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	out := captureOutput(t, func() {
+		runRoot(t, []string{"push", "--config", cfg, "--no-progress"})
+	})
+
+	if _, err := os.Stat(filepath.Join(dir, "built.txt")); err != nil {
+		t.Errorf("build didn't run in the config file's directory: %v\nOutput:\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(elsewhere, "built.txt")); err == nil {
+		t.Error("build ran in the current directory")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mindok/hugodeploy/deploy"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+)
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check for broken links and missing assets before deploying",
+	Long: `Check parses every HTML and CSS file in sourceDir and makes sure the
+links, images, scripts, stylesheets and other files they refer to within the
+site will exist on your webhost after a push. Each broken reference is listed
+with the file and line it is on.
+
+Files excluded by skipfiles and the symlinks setting count as missing, as
+push won't send them. Links to other sites aren't checked. Set baseurl so
+full links to your own site, and root-relative links in a site that isn't
+at the root of its host, are checked too.
+
+Nothing is sent to your webhost. Exits with a non-zero status if anything is
+broken, so it can be used in scripts. push --strict runs the same check and
+won't push if it fails.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		checkSourcePath()
+		jww.INFO.Println("Check: Source Dir Good: ", Source)
+		if err := checkLinks(context.Background()); err != nil {
+			er(err)
+		}
+	},
+}
+
+// checkLinks lists the broken references in sourceDir, failing if there
+// are any
+func checkLinks(ctx context.Context) error {
+	broken, err := deploy.CheckLinks(ctx, deployOptions(), viper.GetString("baseurl"))
+	if err != nil {
+		return err
+	}
+	for _, b := range broken {
+		jww.FEEDBACK.Println(b)
+	}
+	if len(broken) > 0 {
+		return fmt.Errorf("%d broken links found in %s", len(broken), Source)
+	}
+	jww.FEEDBACK.Println("No broken links found")
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(checkCmd)
+}
@@ -0,0 +1,622 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mindok/hugodeploy/deploy"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the typed form of the settings once the config file, environment,
+// environment variables, flags and defaults have been merged.
+type Config struct {
+	Env             string         `mapstructure:"-" yaml:"env,omitempty"`
+	SourceDir       string         `mapstructure:"sourcedir" yaml:"sourcedir"`
+	BaseURL         string         `mapstructure:"baseurl" yaml:"baseurl,omitempty"`
+	DeployRecordDir string         `mapstructure:"deployrecorddir" yaml:"deployrecorddir"`
+	Deployer        string         `mapstructure:"deployer" yaml:"deployer"`
+	DontMinify      bool           `mapstructure:"dontminify" yaml:"dontminify"`
+	Verbose         bool           `mapstructure:"verbose" yaml:"verbose"`
+	Debug           bool           `mapstructure:"debug" yaml:"debug"`
+	SkipFiles       []string       `mapstructure:"skipfiles" yaml:"skipfiles"`
+	Verify          bool           `mapstructure:"verify" yaml:"verify"`
+	VerifyRetries   int            `mapstructure:"verifyretries" yaml:"verifyretries"`
+	Strict          bool           `mapstructure:"strict" yaml:"strict"`
+	Permissions     []string       `mapstructure:"permissions" yaml:"permissions,omitempty"`
+	PreserveModTime bool           `mapstructure:"preservemodtime" yaml:"preservemodtime"`
+	Symlinks        string         `mapstructure:"symlinks" yaml:"symlinks"`
+	Build           bool           `mapstructure:"build" yaml:"build"`
+	BuildCommand    string         `mapstructure:"buildcommand" yaml:"buildcommand,omitempty"`
+	Hooks           HookConfig     `mapstructure:"hooks" yaml:"hooks,omitempty"`
+	Purge           PurgeConfig    `mapstructure:"purge" yaml:"purge,omitempty"`
+	Smoke           SmokeConfig    `mapstructure:"smoke" yaml:"smoke,omitempty"`
+	Budgets         BudgetConfig   `mapstructure:"budgets" yaml:"budgets,omitempty"`
+	Lock            LockConfig     `mapstructure:"lock" yaml:"lock,omitempty"`
+	Manifest        ManifestConfig `mapstructure:"manifest" yaml:"manifest,omitempty"`
+	FTP             FTPConfig      `mapstructure:"ftp" yaml:"ftp"`
+	SFTP            SFTPConfig     `mapstructure:"sftp" yaml:"sftp"`
+}
+
+type FTPConfig struct {
+	Host       string `mapstructure:"host" yaml:"host"`
+	Port       int    `mapstructure:"port" yaml:"port"`
+	User       string `mapstructure:"user" yaml:"user"`
+	Pwd        string `mapstructure:"pwd" yaml:"pwd,omitempty"`
+	PwdCommand string `mapstructure:"pwd_command" yaml:"pwd_command,omitempty"`
+	Keyring    bool   `mapstructure:"keyring" yaml:"keyring"`
+	RootDir    string `mapstructure:"rootdir" yaml:"rootdir"`
+	DisableTLS bool   `mapstructure:"disabletls" yaml:"disabletls"`
+}
+
+type HookConfig struct {
+	PrePush   string `mapstructure:"pre_push" yaml:"pre_push,omitempty"`
+	PostPush  string `mapstructure:"post_push" yaml:"post_push,omitempty"`
+	OnFailure string `mapstructure:"on_failure" yaml:"on_failure,omitempty"`
+}
+
+type PurgeConfig struct {
+	URLFile   string   `mapstructure:"urlfile" yaml:"urlfile,omitempty"`
+	Endpoint  string   `mapstructure:"endpoint" yaml:"endpoint,omitempty"`
+	Method    string   `mapstructure:"method" yaml:"method,omitempty"`
+	Headers   []string `mapstructure:"headers" yaml:"headers,omitempty"`
+	Body      string   `mapstructure:"body" yaml:"body,omitempty"`
+	Token     string   `mapstructure:"token" yaml:"token,omitempty"`
+	BatchSize int      `mapstructure:"batchsize" yaml:"batchsize,omitempty"`
+}
+
+type SmokeConfig struct {
+	URLs    []string `mapstructure:"urls" yaml:"urls,omitempty"`
+	Sample  int      `mapstructure:"sample" yaml:"sample,omitempty"`
+	BaseURL string   `mapstructure:"baseurl" yaml:"baseurl,omitempty"`
+}
+
+type BudgetConfig struct {
+	MaxFileSize string   `mapstructure:"maxfilesize" yaml:"maxfilesize,omitempty"`
+	Files       []string `mapstructure:"files" yaml:"files,omitempty"`
+	Types       []string `mapstructure:"types" yaml:"types,omitempty"`
+	Total       string   `mapstructure:"total" yaml:"total,omitempty"`
+}
+
+type LockConfig struct {
+	Remote     bool   `mapstructure:"remote" yaml:"remote"`
+	StaleAfter string `mapstructure:"staleafter" yaml:"staleafter,omitempty"`
+}
+
+type ManifestConfig struct {
+	Remote bool `mapstructure:"remote" yaml:"remote"`
+}
+
+type SFTPConfig struct {
+	Host                  string `mapstructure:"host" yaml:"host"`
+	Port                  int    `mapstructure:"port" yaml:"port"`
+	User                  string `mapstructure:"user" yaml:"user"`
+	Pwd                   string `mapstructure:"pwd" yaml:"pwd,omitempty"`
+	PwdCommand            string `mapstructure:"pwd_command" yaml:"pwd_command,omitempty"`
+	Keyring               bool   `mapstructure:"keyring" yaml:"keyring"`
+	RootDir               string `mapstructure:"rootdir" yaml:"rootdir"`
+	KnownHosts            string `mapstructure:"knownhosts" yaml:"knownhosts,omitempty"`
+	InsecureIgnoreHostKey bool   `mapstructure:"insecureignorehostkey" yaml:"insecureignorehostkey"`
+}
+
+type settingKind int
+
+const (
+	KIND_STRING settingKind = iota
+	KIND_INT
+	KIND_BOOL
+	KIND_STRING_LIST
+)
+
+func (k settingKind) String() string {
+	switch k {
+	case KIND_INT:
+		return "a whole number"
+	case KIND_BOOL:
+		return "true or false"
+	case KIND_STRING_LIST:
+		return "a list"
+	}
+	return "text"
+}
+
+// configSchema lists every setting that can appear in the config file (or in
+// an environment) and the type of value it takes. Keys are lower case as
+// viper folds case.
+var configSchema = map[string]settingKind{
+	"sourcedir":       KIND_STRING,
+	"baseurl":         KIND_STRING,
+	"deployrecorddir": KIND_STRING,
+	"deployer":        KIND_STRING,
+	"dontminify":      KIND_BOOL,
+	"verbose":         KIND_BOOL,
+	"debug":           KIND_BOOL,
+	"skipfiles":       KIND_STRING_LIST,
+	"verify":          KIND_BOOL,
+	"verifyretries":   KIND_INT,
+	"strict":          KIND_BOOL,
+	"permissions":     KIND_STRING_LIST,
+	"preservemodtime": KIND_BOOL,
+	"symlinks":        KIND_STRING,
+	"build":           KIND_BOOL,
+	"buildcommand":    KIND_STRING,
+
+	"hooks.pre_push":   KIND_STRING,
+	"hooks.post_push":  KIND_STRING,
+	"hooks.on_failure": KIND_STRING,
+
+	"purge.urlfile":   KIND_STRING,
+	"purge.endpoint":  KIND_STRING,
+	"purge.method":    KIND_STRING,
+	"purge.headers":   KIND_STRING_LIST,
+	"purge.body":      KIND_STRING,
+	"purge.token":     KIND_STRING,
+	"purge.batchsize": KIND_INT,
+
+	"smoke.urls":    KIND_STRING_LIST,
+	"smoke.sample":  KIND_INT,
+	"smoke.baseurl": KIND_STRING,
+
+	"budgets.maxfilesize": KIND_STRING,
+	"budgets.files":       KIND_STRING_LIST,
+	"budgets.types":       KIND_STRING_LIST,
+	"budgets.total":       KIND_STRING,
+
+	"lock.remote":     KIND_BOOL,
+	"lock.staleafter": KIND_STRING,
+
+	"manifest.remote": KIND_BOOL,
+
+	"ftp.host":        KIND_STRING,
+	"ftp.port":        KIND_INT,
+	"ftp.user":        KIND_STRING,
+	"ftp.pwd":         KIND_STRING,
+	"ftp.pwd_command": KIND_STRING,
+	"ftp.keyring":     KIND_BOOL,
+	"ftp.rootdir":     KIND_STRING,
+	"ftp.disabletls":  KIND_BOOL,
+
+	"sftp.host":                  KIND_STRING,
+	"sftp.port":                  KIND_INT,
+	"sftp.user":                  KIND_STRING,
+	"sftp.pwd":                   KIND_STRING,
+	"sftp.pwd_command":           KIND_STRING,
+	"sftp.keyring":               KIND_BOOL,
+	"sftp.rootdir":               KIND_STRING,
+	"sftp.knownhosts":            KIND_STRING,
+	"sftp.insecureignorehostkey": KIND_BOOL,
+}
+
+// configProblem is a single finding from validateConfig
+type configProblem struct {
+	Key     string
+	Msg     string
+	Warning bool
+}
+
+func (p configProblem) String() string {
+	level := "ERROR"
+	if p.Warning {
+		level = "WARN "
+	}
+	if p.Key == "" {
+		return level + " " + p.Msg
+	}
+	return level + " " + p.Key + ": " + p.Msg
+}
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Check and display configuration settings",
+	Long: `Config has subcommands to validate the config file and to show the
+settings hugodeploy will actually use.`,
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validate the config file",
+	Long: `Validate checks the config file for syntax errors, unknown settings
+(usually typos), values of the wrong type and missing connection settings
+for the selected deployer. Environments are checked too.
+
+Exits with a non-zero status if there are any errors.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		problems := validateConfig()
+		errors := 0
+		for _, p := range problems {
+			jww.FEEDBACK.Println(p)
+			if !p.Warning {
+				errors++
+			}
+		}
+		if errors > 0 {
+			jww.FEEDBACK.Println("Config file has", errors, "error(s)")
+			os.Exit(-1)
+		}
+		jww.FEEDBACK.Println("Config file is valid:", viper.ConfigFileUsed())
+	},
+}
+
+var ShowEffective bool
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show configuration settings",
+	Long: `Show prints the settings from the config file. With --effective it prints
+the settings hugodeploy will use once the selected environment, environment
+variables, command-line flags and defaults have been merged in.
+
+Passwords are masked.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var out interface{}
+		if ShowEffective {
+			cfg, err := loadConfig()
+			if err != nil {
+				er(err)
+			}
+			cfg.redact()
+			out = cfg
+		} else {
+			v, err := readConfigFile()
+			if err != nil {
+				er(err)
+			}
+			out = redactSettings("", v.AllSettings())
+		}
+		b, err := yaml.Marshal(out)
+		if err != nil {
+			er(err)
+		}
+		fmt.Print(string(b))
+	},
+}
+
+// loadConfig decodes the merged settings into a Config
+func loadConfig() (*Config, error) {
+	cfg := &Config{}
+	if err := viper.Unmarshal(cfg); err != nil {
+		return nil, fmt.Errorf("error in settings: %v", err)
+	}
+	cfg.Env = Env
+	return cfg, nil
+}
+
+// redact masks every setting deploy.IsSecretKey says is secret, as
+// redactSettings does for the config file
+func (c *Config) redact() {
+	redactStruct("", reflect.ValueOf(c).Elem())
+}
+
+// redactStruct masks the secret string fields of v, a settings struct, and
+// of the structs inside it. Keys come from the mapstructure tags.
+func redactStruct(prefix string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("mapstructure"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Struct:
+			redactStruct(prefix+key+".", f)
+		case reflect.String:
+			f.SetString(deploy.RedactSetting(prefix+key, f.String()).(string))
+		}
+	}
+}
+
+// redactSettings masks secrets in a nested settings map
+func redactSettings(prefix string, settings map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		if m, ok := v.(map[string]interface{}); ok {
+			out[k] = redactSettings(prefix+k+".", m)
+		} else {
+			out[k] = deploy.RedactSetting(prefix+k, v)
+		}
+	}
+	return out
+}
+
+// readConfigFile reads the config file on its own, without defaults, flags or
+// environment variables, so we can see exactly what the user wrote
+func readConfigFile() (*viper.Viper, error) {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return nil, fmt.Errorf("no config file found. Run hugodeploy init to create one")
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("can't read config file %s: %v", file, err)
+	}
+	return v, nil
+}
+
+// validateConfig checks the config file against configSchema and the merged
+// settings for anything push would trip over
+func validateConfig() []configProblem {
+	// Without a config file everything comes from defaults (including the
+	// Hugo site config), the environment and flags, which is fine if they
+	// cover what's needed
+	v, err := viper.New(), error(nil)
+	if viper.ConfigFileUsed() != "" {
+		v, err = readConfigFile()
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "\t") || strings.Contains(err.Error(), "found character that cannot start any token") {
+			err = fmt.Errorf("%v (YAML must be indented with spaces, not tabs)", err)
+		}
+		return []configProblem{{Msg: err.Error()}}
+	}
+
+	problems := []configProblem{}
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if strings.HasPrefix(key, "environments.") {
+			continue
+		}
+		problems = append(problems, checkSetting(key, key, v.Get(key))...)
+	}
+
+	if envs := v.Get("environments"); envs != nil {
+		m, ok := envs.(map[string]interface{})
+		if !ok {
+			problems = append(problems, configProblem{Key: "environments", Msg: "must be a section with one entry per environment"})
+		}
+		for name := range m {
+			prefix := "environments." + name + "."
+			for _, key := range keys {
+				if strings.HasPrefix(key, prefix) {
+					problems = append(problems, checkSetting(key, strings.TrimPrefix(key, prefix), v.Get(key))...)
+				}
+			}
+		}
+	}
+
+	for _, p := range problems {
+		if !p.Warning {
+			// Merged settings can't be decoded until the types are fixed
+			return problems
+		}
+	}
+	return append(problems, checkEffectiveSettings()...)
+}
+
+// checkSetting checks a single config file entry. key is the full key for
+// reporting, schemaKey the key with any environment prefix removed.
+func checkSetting(key, schemaKey string, value interface{}) []configProblem {
+	kind, known := configSchema[schemaKey]
+	if !known {
+		msg := "unknown setting - it will be ignored"
+		if s := suggestKey(schemaKey); s != "" {
+			msg += ". Did you mean " + s + "?"
+		}
+		return []configProblem{{key, msg, true}}
+	}
+	if !valueIsKind(value, kind) {
+		return []configProblem{{Key: key, Msg: fmt.Sprintf("must be %v, got %v", kind, value)}}
+	}
+	return nil
+}
+
+func valueIsKind(value interface{}, kind settingKind) bool {
+	switch kind {
+	case KIND_INT:
+		switch x := value.(type) {
+		case int, int64, uint64:
+			return true
+		case float64:
+			return x == float64(int64(x))
+		case string:
+			_, err := strconv.Atoi(x)
+			return err == nil
+		}
+		return false
+	case KIND_BOOL:
+		switch x := value.(type) {
+		case bool:
+			return true
+		case string:
+			_, err := strconv.ParseBool(x)
+			return err == nil
+		}
+		return false
+	case KIND_STRING_LIST:
+		switch x := value.(type) {
+		case []interface{}:
+			for _, e := range x {
+				if _, ok := e.(map[string]interface{}); ok {
+					return false
+				}
+			}
+			return true
+		case []string:
+			return true
+		}
+		return false
+	default:
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return false
+		}
+		return true
+	}
+}
+
+// connectionUser is the user the named deployer logs in as: its user
+// setting, or else the login for its host in ~/.netrc
+func connectionUser(name string) string {
+	if user := viper.GetString(name + ".user"); user != "" {
+		return user
+	}
+	login, err := deploy.NetrcLogin(viper.GetString(name + ".host"))
+	if err != nil {
+		jww.DEBUG.Println(err)
+	}
+	return login
+}
+
+// checkEffectiveSettings checks the merged settings, e.g. that the selected
+// deployer has what it needs to connect
+func checkEffectiveSettings() []configProblem {
+	problems := []configProblem{}
+	cfg, err := loadConfig()
+	if err != nil {
+		return append(problems, configProblem{Msg: err.Error()})
+	}
+
+	name := strings.ToLower(cfg.Deployer)
+	if _, err := deploy.NewDeployer(name); err != nil {
+		return append(problems, configProblem{Key: "deployer", Msg: err.Error()})
+	}
+	for _, k := range []string{"host", "port"} {
+		if viper.GetString(name+"."+k) == "" {
+			problems = append(problems, configProblem{Key: name + "." + k, Msg: "required for the " + name + " deployer"})
+		}
+	}
+	if connectionUser(name) == "" {
+		problems = append(problems, configProblem{Key: name + ".user", Msg: "required for the " + name + " deployer, unless ~/.netrc has a login for the host"})
+	}
+	if viper.GetString(name+".rootdir") == "" {
+		problems = append(problems, configProblem{name + ".rootdir", "not set - '/' will be used", true})
+	}
+	if cfg.VerifyRetries < 0 {
+		problems = append(problems, configProblem{Key: "verifyretries", Msg: "can't be negative"})
+	}
+	if _, err := deploy.ParsePermissionRules(cfg.Permissions); err != nil {
+		problems = append(problems, configProblem{Key: "permissions", Msg: err.Error()})
+	}
+	if err := deploy.CheckBudgets(deployBudgets()); err != nil {
+		problems = append(problems, configProblem{Key: "budgets", Msg: err.Error()})
+	}
+	if _, err := time.ParseDuration(cfg.Lock.StaleAfter); err != nil {
+		problems = append(problems, configProblem{Key: "lock.staleafter", Msg: "should be a duration such as 30m or 2h"})
+	}
+	if purgeEnabled() {
+		if cfg.BaseURL == "" {
+			problems = append(problems, configProblem{Key: "baseurl", Msg: "needed to work out the URLs to purge"})
+		} else if _, err := deploy.PublicURL(cfg.BaseURL, "/"); err != nil {
+			problems = append(problems, configProblem{Key: "baseurl", Msg: err.Error()})
+		}
+		for _, t := range append([]string{cfg.Purge.Body}, cfg.Purge.Headers...) {
+			if _, err := template.New("").Funcs(purgeFuncs).Parse(t); err != nil {
+				problems = append(problems, configProblem{Key: "purge", Msg: err.Error()})
+			}
+		}
+	}
+	if smokeEnabled() {
+		if _, err := smokeURL(smokeBaseURL(), "/"); err != nil && (cfg.Smoke.Sample > 0 || hasRelativeURL(cfg.Smoke.URLs)) {
+			problems = append(problems, configProblem{Key: "smoke", Msg: "needs baseurl (or smoke.baseurl) to find the pages to check: " + err.Error()})
+		}
+	}
+	if err := deploy.CheckSymlinkPolicy(cfg.Symlinks); err != nil {
+		problems = append(problems, configProblem{Key: "symlinks", Msg: err.Error()})
+	} else if cfg.Symlinks == deploy.SYMLINKS_PRESERVE && name == "ftp" {
+		problems = append(problems, configProblem{Key: "symlinks", Msg: "FTP can't create links - use follow or skip with the ftp deployer"})
+	}
+
+	for _, dir := range []struct{ key, value string }{{"sourcedir", cfg.SourceDir}, {"deployrecorddir", cfg.DeployRecordDir}} {
+		if dir.key == "deployrecorddir" && cfg.Manifest.Remote {
+			continue // Only used, if there, to start the manifest
+		}
+		if b, _ := dirExists(dir.value); !b {
+			problems = append(problems, configProblem{dir.key, "directory " + dir.value + " does not exist", true})
+		}
+	}
+	return problems
+}
+
+// hasRelativeURL reports whether any of urls needs a base URL to fetch
+func hasRelativeURL(urls []string) bool {
+	for _, u := range urls {
+		if p, err := url.Parse(u); err != nil || !p.IsAbs() {
+			return true
+		}
+	}
+	return false
+}
+
+// suggestKey finds the closest known setting to a misspelt one
+func suggestKey(key string) string {
+	best, bestDist := "", 3
+	for k := range configSchema {
+		if d := editDistance(key, k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// mustValidateConfig stops before doing anything if the config has errors
+func mustValidateConfig() {
+	failed := false
+	for _, p := range validateConfig() {
+		jww.FEEDBACK.Println(p)
+		failed = failed || !p.Warning
+	}
+	if failed {
+		er("config file has errors. Run hugodeploy config validate for details")
+	}
+}
+
+func init() {
+	configShowCmd.Flags().BoolVar(&ShowEffective, "effective", false, "show the settings after environment, flags and defaults are merged")
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configShowCmd)
+	RootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,289 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mindok/hugodeploy/deploy"
+	"github.com/spf13/cobra"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+)
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check configuration and connectivity before deploying",
+	Long: `Doctor walks through each step push takes to reach your webhost and
+reports what works and what doesn't, with suggestions for fixing failures:
+config and directories, credentials, connection, TLS, the website root
+directory, write access (a probe file is created then deleted) and latency.
+
+Nothing in your website is changed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		d := &doctor{}
+		d.run()
+		if d.failed > 0 {
+			jww.FEEDBACK.Println(d.failed, "check(s) failed")
+			os.Exit(-1)
+		}
+		jww.FEEDBACK.Println("All checks passed")
+	},
+}
+
+const doctorProbeFile = ".hugodeploy-doctor-probe"
+const doctorPings = 5
+
+type doctor struct {
+	failed int
+}
+
+func (d *doctor) ok(step, detail string) {
+	jww.FEEDBACK.Println("[ OK ] ", step+": ", detail)
+}
+
+func (d *doctor) warn(step, detail string, hints ...string) {
+	jww.FEEDBACK.Println("[WARN] ", step+": ", detail)
+	for _, h := range hints {
+		jww.FEEDBACK.Println("         -> ", h)
+	}
+}
+
+func (d *doctor) fail(step string, err error, hints ...string) {
+	d.failed++
+	jww.FEEDBACK.Println("[FAIL] ", step+": ", err)
+	for _, h := range hints {
+		jww.FEEDBACK.Println("         -> ", h)
+	}
+}
+
+func (d *doctor) run() {
+	d.checkConfig()
+
+	name := viper.GetString("deployer")
+	target, err := newDeployer()
+	if err != nil {
+		d.fail("Deployer", err, "Set deployer in the config file to one of: "+strings.Join(deploy.DeployerNames(), ", "))
+		return
+	}
+	d.ok("Deployer", name)
+
+	if !d.checkCredentials(name, target) {
+		return
+	}
+
+	start := time.Now()
+	if err := target.Initialise(); err != nil {
+		step, hints := diagnoseConnectError(name, err)
+		d.fail(step, err, hints...)
+		return
+	}
+	defer target.Cleanup()
+	d.ok("Connect", fmt.Sprintf("connected and logged in to %s:%s in %v", viper.GetString(name+".host"), viper.GetString(name+".port"), time.Since(start).Round(time.Millisecond)))
+
+	d.checkEncryption(target)
+
+	prober, canProbe := target.(deploy.Prober)
+	if canProbe {
+		if err := prober.CheckRoot(); err != nil {
+			d.fail("Root dir", err, "Check "+name+".rootdir is the website root relative to where you land after logging in, e.g. /public_html/")
+			return
+		}
+		d.ok("Root dir", viper.GetString(name+".rootdir")+" exists")
+	}
+
+	d.checkWritable(target, name)
+
+	if canProbe {
+		d.checkLatency(prober)
+	}
+}
+
+func (d *doctor) checkConfig() {
+	if f := viper.ConfigFileUsed(); f != "" {
+		if b, _ := exists(f); b {
+			d.ok("Config", f)
+		} else {
+			d.fail("Config", fmt.Errorf("config file %s not found", f), "Run hugodeploy init to create one, or point --config at it")
+		}
+	} else {
+		d.fail("Config", fmt.Errorf("no config file found"), "Run hugodeploy init to create one, or point --config at it")
+	}
+
+	for _, p := range validateConfig() {
+		if p.Key == "sourcedir" || p.Key == "deployrecorddir" {
+			continue // Checked below with more helpful hints
+		}
+		if p.Warning {
+			d.warn("Config", p.Key+": "+p.Msg)
+		} else {
+			d.fail("Config", fmt.Errorf("%s", strings.TrimPrefix(p.Key+": "+p.Msg, ": ")), "Run hugodeploy config validate for details")
+		}
+	}
+
+	for _, dir := range []struct{ key, hint string }{
+		{"sourceDir", "Build your site first (e.g. run hugo) or fix sourceDir in the config file"},
+		{"deployRecordDir", "Run hugodeploy init to create it"},
+	} {
+		path := viper.GetString(dir.key)
+		if b, err := dirExists(path); err != nil {
+			d.fail(dir.key, err)
+		} else if !b && dir.key == "deployRecordDir" && viper.GetBool("manifest.remote") {
+			d.ok(dir.key, "not needed - the manifest on the target is used")
+		} else if !b {
+			d.fail(dir.key, fmt.Errorf("directory %s does not exist", path), dir.hint)
+		} else {
+			d.ok(dir.key, path)
+		}
+	}
+}
+
+// checkCredentials resolves the password up front so problems with the
+// password sources are reported separately from connection problems
+func (d *doctor) checkCredentials(name string, target deploy.Deployer) bool {
+	var pwd *string
+	switch t := target.(type) {
+	case *deploy.FTPDeployer:
+		pwd = &t.PWD
+	case *deploy.SFTPDeployer:
+		pwd = &t.PWD
+	default:
+		return true
+	}
+
+	missing := []string{}
+	for _, k := range []string{"host", "port"} {
+		if viper.GetString(name+"."+k) == "" {
+			missing = append(missing, name+"."+k)
+		}
+	}
+	user := connectionUser(name)
+	if user == "" {
+		missing = append(missing, name+".user")
+	}
+	if len(missing) > 0 {
+		d.fail("Settings", fmt.Errorf("missing %s", strings.Join(missing, ", ")), "Add them to the "+name+" section of the config file (the user can come from ~/.netrc instead)")
+		return false
+	}
+	d.ok("Settings", user+"@"+viper.GetString(name+".host")+":"+viper.GetString(name+".port"))
+
+	if *pwd != "" {
+		deploy.RegisterSecret(*pwd)
+		d.ok("Credentials", "password given on the command line")
+		return true
+	}
+	var err error
+	if *pwd, err = deploy.ResolvePassword(name, viper.GetString(name+".host"), user); err != nil {
+		d.fail("Credentials", err, "See Credentials in the README for the places hugodeploy looks for passwords")
+		return false
+	}
+	d.ok("Credentials", "password found")
+	return true
+}
+
+func (d *doctor) checkEncryption(target deploy.Deployer) {
+	switch t := target.(type) {
+	case *deploy.FTPDeployer:
+		if t.DisableTLS {
+			d.warn("TLS", "disabled - your password and files are sent in clear text",
+				"Remove ftp.disabletls from the config file unless your server really doesn't support TLS")
+		} else {
+			d.ok("TLS", "AUTH TLS negotiated")
+		}
+	case *deploy.SFTPDeployer:
+		if viper.GetBool("sftp.insecureignorehostkey") {
+			d.warn("Encryption", "SSH transport encrypted but the server's host key is not being checked",
+				"Remove sftp.insecureignorehostkey once the server is in your known_hosts file")
+		} else {
+			d.ok("Encryption", "SSH transport encrypted, host key verified")
+		}
+	}
+}
+
+func (d *doctor) checkWritable(target deploy.Deployer, name string) {
+	probe := string(os.PathSeparator) + doctorProbeFile
+	data := []byte("hugodeploy doctor probe " + time.Now().Format(time.RFC3339) + "\n")
+	if err := target.ApplyCommand(&deploy.DeployCommand{RelPath: probe, Contents: data, Command: deploy.COMMAND_FILE_ADD}); err != nil {
+		d.fail("Write access", err, "Check "+name+".user has permission to write to "+name+".rootdir, and that the server isn't out of disk quota")
+		return
+	}
+	if err := target.ApplyCommand(&deploy.DeployCommand{RelPath: probe, Command: deploy.COMMAND_FILE_DEL}); err != nil {
+		d.fail("Write access", err, "The probe file was created but couldn't be deleted. Check delete permissions and remove "+doctorProbeFile+" by hand")
+		return
+	}
+	d.ok("Write access", "created and deleted "+doctorProbeFile)
+}
+
+func (d *doctor) checkLatency(prober deploy.Prober) {
+	var min, max, total time.Duration
+	for i := 0; i < doctorPings; i++ {
+		start := time.Now()
+		if err := prober.Ping(); err != nil {
+			d.fail("Latency", err, "The connection dropped after logging in. Try again, or check for an unreliable network")
+			return
+		}
+		rtt := time.Since(start)
+		total += rtt
+		if i == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+	}
+	avg := total / doctorPings
+	detail := fmt.Sprintf("round trip min %v avg %v max %v", min.Round(time.Millisecond), avg.Round(time.Millisecond), max.Round(time.Millisecond))
+	if avg > time.Second {
+		d.warn("Latency", detail, "Each file costs several round trips so pushes with many changed files will be slow")
+		return
+	}
+	d.ok("Latency", detail)
+}
+
+// diagnoseConnectError works out which connection step failed and what the
+// user might do about it
+func diagnoseConnectError(name string, err error) (string, []string) {
+	msg := strings.ToLower(err.Error())
+	hostPort := name + ".host and " + name + ".port"
+	switch {
+	case strings.Contains(msg, "no such host"):
+		return "Connect", []string{"The host name doesn't resolve. Check " + name + ".host"}
+	case strings.Contains(msg, "connection refused"):
+		return "Connect", []string{"Nothing is listening there. Check " + hostPort + " (usually 21 for FTP, 22 for SFTP)"}
+	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
+		return "Connect", []string{"The server isn't responding. Check " + hostPort + " and that a firewall isn't blocking outgoing connections"}
+	case strings.Contains(msg, "tls activation"):
+		return "TLS", []string{"The server may not support FTP over TLS (AUTH TLS). Check with your host.",
+			"As a last resort set ftp.disabletls: true - your password will be sent in clear text"}
+	case strings.Contains(msg, "login failed"), strings.Contains(msg, "unable to authenticate"), strings.Contains(msg, "530"):
+		return "Login", []string{"The server rejected the user name or password. Check " + name + ".user and the password (see Credentials in the README)"}
+	case strings.Contains(msg, "key is unknown"), strings.Contains(msg, "known hosts"):
+		return "Host key", []string{"Connect once with ssh to add the server to known_hosts, or set sftp.knownhosts"}
+	case strings.Contains(msg, "key mismatch"):
+		return "Host key", []string{"The server's host key has changed. Confirm with your host before updating known_hosts"}
+	case strings.Contains(msg, "initialising"):
+		return "Settings", []string{"Fix the settings listed above in the config file"}
+	}
+	return "Connect", []string{"Run with --debug to see the conversation with the server"}
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+	initPasswordFlags(doctorCmd)
+}
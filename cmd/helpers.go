@@ -23,6 +23,8 @@ import (
 	"path/filepath"
 	"strings"
 	"text/template"
+
+	"github.com/mindok/hugodeploy/deploy"
 )
 
 var funcMap template.FuncMap
@@ -33,8 +35,10 @@ var projectBase = ""
 // for testing only
 var testWd = ""
 
+// er reports a fatal error and exits. With --json it goes to stderr, so
+// stdout stays valid JSON lines.
 func er(msg interface{}) {
-	fmt.Println("Error:", msg)
+	fmt.Fprintln(logOutput(), "Error:", deploy.Redact(fmt.Sprint(msg)))
 	os.Exit(-1)
 }
 
@@ -0,0 +1,217 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/mindok/hugodeploy/deploy"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+)
+
+// Hook names, as used in the config file's hooks section
+const (
+	HOOK_PRE_PUSH   = "pre_push"
+	HOOK_POST_PUSH  = "post_push"
+	HOOK_ON_FAILURE = "on_failure"
+)
+
+// hooks runs the shell commands configured to run around a push. It watches
+// the deployment as an Observer so it knows what was planned and how it went.
+// pre_push runs once there is something to deploy, before connecting, and
+// stops the push if it fails. post_push runs after a successful push and
+// on_failure after a failed one, including one stopped by pre_push and one
+// that failed before there was anything to deploy.
+type hooks struct {
+	commands   map[string]string
+	plan       *deploy.Plan
+	err        error // Set if post_push failed
+	failureRun bool  // on_failure has run for the latest deployment
+}
+
+func newHooks() *hooks {
+	h := &hooks{commands: make(map[string]string)}
+	for _, name := range []string{HOOK_PRE_PUSH, HOOK_POST_PUSH, HOOK_ON_FAILURE} {
+		if c := viper.GetString("hooks." + name); c != "" {
+			h.commands[name] = c
+		}
+	}
+	return h
+}
+
+// beforeConnect is used as deploy.Options.BeforeConnect
+func (h *hooks) beforeConnect(plan *deploy.Plan) error {
+	h.plan = plan
+	return h.run(HOOK_PRE_PUSH, "pending", nil, nil)
+}
+
+func (h *hooks) Notify(ev *deploy.Event) {
+	switch ev.Type {
+	case deploy.EVENT_SCAN_FINISH:
+		h.plan = ev.Plan
+	case deploy.EVENT_SUMMARY:
+		if ev.Err != nil {
+			h.failed(ev.Summary, ev.Err)
+			return
+		}
+		h.failureRun = false
+		if h.plan == nil || len(h.plan.Commands) == 0 {
+			return
+		}
+		if err := h.run(HOOK_POST_PUSH, "success", ev.Summary, nil); err != nil {
+			jww.ERROR.Println(err)
+			h.err = err
+		}
+	}
+}
+
+// failed runs on_failure for a failed deployment
+func (h *hooks) failed(summary *deploy.Summary, deployErr error) {
+	h.failureRun = true
+	if err := h.run(HOOK_ON_FAILURE, "failed", summary, deployErr); err != nil {
+		jww.ERROR.Println(err)
+	}
+}
+
+// fail ends a push that failed with msg, first running on_failure if it
+// hasn't already run for this failure
+func (h *hooks) fail(msg interface{}) {
+	if !h.failureRun {
+		h.failed(nil, fmt.Errorf("%v", msg))
+	}
+	er(msg)
+}
+
+// hookInfo is written as JSON to the file named by HUGODEPLOY_INFO_FILE
+type hookInfo struct {
+	Hook             string         `json:"hook"`
+	Status           string         `json:"status"`
+	Deployer         string         `json:"deployer"`
+	Target           string         `json:"target"`
+	Environment      string         `json:"environment,omitempty"`
+	SourceDir        string         `json:"sourcedir"`
+	Planned          int            `json:"planned"`
+	Commands         map[string]int `json:"commands"` //Planned for pre_push, completed afterwards
+	Failed           int            `json:"failed"`
+	BytesTransferred int64          `json:"bytes_transferred"`
+	Files            []hookFile     `json:"files"`
+	Error            string         `json:"error,omitempty"`
+}
+
+type hookFile struct {
+	Path    string `json:"path"`
+	Command string `json:"command"`
+}
+
+// run runs the named hook, if there is one, passing it details of the push
+// through environment variables and files
+func (h *hooks) run(name, status string, summary *deploy.Summary, deployErr error) error {
+	command, ok := h.commands[name]
+	if !ok {
+		return nil
+	}
+
+	info := hookInfo{
+		Hook:        name,
+		Status:      status,
+		Deployer:    viper.GetString("deployer"),
+		Target:      hookTarget(),
+		Environment: Env,
+		SourceDir:   viper.GetString("sourceDir"),
+		Commands:    make(map[string]int),
+		Files:       []hookFile{},
+	}
+	counts := make(map[deploy.CommandType]int)
+	if h.plan != nil {
+		info.Planned = len(h.plan.Commands)
+		for _, cmd := range h.plan.Commands {
+			info.Files = append(info.Files, hookFile{filepath.ToSlash(cmd.RelPath), cmd.GetCommandDesc()})
+			if summary == nil {
+				counts[cmd.Command]++
+			}
+		}
+	}
+	if summary != nil {
+		counts = summary.Commands
+		info.Failed = summary.Failed
+		info.BytesTransferred = summary.BytesTransferred
+	}
+	for c, n := range counts {
+		info.Commands[(&deploy.DeployCommand{Command: c}).GetCommandDesc()] = n
+	}
+	if deployErr != nil {
+		info.Error = deploy.Redact(deployErr.Error())
+	}
+
+	dir, err := ioutil.TempDir("", "hugodeploy-hook")
+	if err != nil {
+		return fmt.Errorf("%s hook: %v", name, err)
+	}
+	defer os.RemoveAll(dir)
+	infoFile := filepath.Join(dir, "deploy.json")
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%s hook: %v", name, err)
+	}
+	if err := ioutil.WriteFile(infoFile, data, 0600); err != nil {
+		return fmt.Errorf("%s hook: %v", name, err)
+	}
+	filesFile := filepath.Join(dir, "files.txt")
+	list := ""
+	for _, f := range info.Files {
+		list += f.Path + "\n"
+	}
+	if err := ioutil.WriteFile(filesFile, []byte(list), 0600); err != nil {
+		return fmt.Errorf("%s hook: %v", name, err)
+	}
+
+	c := shellCommand(command)
+	c.Env = append(os.Environ(),
+		"HUGODEPLOY_HOOK="+name,
+		"HUGODEPLOY_STATUS="+status,
+		"HUGODEPLOY_DEPLOYER="+info.Deployer,
+		"HUGODEPLOY_TARGET="+info.Target,
+		"HUGODEPLOY_ENV="+Env,
+		"HUGODEPLOY_SOURCEDIR="+info.SourceDir,
+		"HUGODEPLOY_PLANNED="+strconv.Itoa(info.Planned),
+		"HUGODEPLOY_ADDED="+strconv.Itoa(counts[deploy.COMMAND_FILE_ADD]+counts[deploy.COMMAND_DIR_ADD]+counts[deploy.COMMAND_LINK_ADD]),
+		"HUGODEPLOY_UPDATED="+strconv.Itoa(counts[deploy.COMMAND_FILE_UPD]),
+		"HUGODEPLOY_DELETED="+strconv.Itoa(counts[deploy.COMMAND_FILE_DEL]+counts[deploy.COMMAND_DIR_DEL]),
+		"HUGODEPLOY_FAILED="+strconv.Itoa(info.Failed),
+		"HUGODEPLOY_CHANGED_FILES="+filesFile,
+		"HUGODEPLOY_INFO_FILE="+infoFile,
+		"HUGODEPLOY_ERROR="+info.Error,
+	)
+	c.Stdout = logOutput()
+	c.Stderr = os.Stderr
+	jww.FEEDBACK.Println("Running ", name, " hook: ", command)
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %v", name, err)
+	}
+	return nil
+}
+
+// hookTarget describes where the push is going, without credentials
+func hookTarget() string {
+	name := viper.GetString("deployer")
+	return fmt.Sprintf("%s://%s@%s:%s%s", name, viper.GetString(name+".user"), viper.GetString(name+".host"),
+		viper.GetString(name+".port"), viper.GetString(name+".rootdir"))
+}
@@ -0,0 +1,118 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+)
+
+// The names Hugo looks for its config under, in order of preference
+var hugoConfigNames = []string{"hugo", "config"}
+var hugoConfigExts = []string{"toml", "yaml", "yml", "json"}
+
+// hugoDefaultEnvironment is the environment hugo builds for unless told otherwise
+const hugoDefaultEnvironment = "production"
+
+// hugoSite holds the settings hugodeploy can take from a Hugo site's config
+type hugoSite struct {
+	Files      []string // Config files read, in the order applied
+	PublishDir string
+	BaseURL    string
+}
+
+// readHugoSite reads the Hugo config for the site in dir as hugo would build
+// it for environment env: the config file in dir, then config/_default,
+// then config/<env>, each overriding the last. It returns nil if dir isn't a
+// Hugo site.
+func readHugoSite(dir, env string) (*hugoSite, error) {
+	site := &hugoSite{PublishDir: "public"}
+	for _, d := range []string{dir, filepath.Join(dir, "config", "_default"), filepath.Join(dir, "config", env)} {
+		file := findHugoConfig(d)
+		if file == "" {
+			continue
+		}
+		v := viper.New()
+		v.SetConfigFile(file)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("error reading Hugo config %s: %v", file, err)
+		}
+		site.Files = append(site.Files, file)
+		if v.IsSet("publishdir") {
+			site.PublishDir = v.GetString("publishdir")
+		}
+		if v.IsSet("baseurl") {
+			site.BaseURL = v.GetString("baseurl")
+		}
+	}
+	if len(site.Files) == 0 {
+		return nil, nil
+	}
+	return site, nil
+}
+
+// findHugoConfig returns the Hugo config file in dir, or "" if there isn't one
+func findHugoConfig(dir string) string {
+	for _, name := range hugoConfigNames {
+		for _, ext := range hugoConfigExts {
+			p := filepath.Join(dir, name+"."+ext)
+			if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// hugoEnvironment is the Hugo environment matching this run: HUGO_ENVIRONMENT
+// if set, otherwise the --env name, otherwise production as for hugo itself
+func hugoEnvironment() string {
+	if e := os.Getenv("HUGO_ENVIRONMENT"); e != "" {
+		return e
+	}
+	if Env != "" {
+		return Env
+	}
+	return hugoDefaultEnvironment
+}
+
+// loadHugoDefaults uses the publishDir and baseURL of the Hugo site alongside
+// the config file (or in the current directory if there's no config file) as
+// the defaults for sourceDir and baseURL. Settings in the config file still
+// win. Returns whether a Hugo site was found.
+func loadHugoDefaults() bool {
+	dir := "."
+	if f := viper.ConfigFileUsed(); f != "" {
+		dir = filepath.Dir(f)
+	}
+	site, err := readHugoSite(dir, hugoEnvironment())
+	if err != nil {
+		jww.WARN.Println(err)
+		return false
+	}
+	if site == nil {
+		return false
+	}
+	jww.INFO.Println("Hugo site config: ", site.Files)
+	viper.SetDefault("sourceDir", site.PublishDir)
+	if site.BaseURL != "" {
+		viper.SetDefault("baseURL", site.BaseURL)
+	}
+	return true
+}
@@ -181,25 +181,39 @@ func createConfigFile() {
 	template := `
 # HugoDeploy Configuration File
 
+# Deployment target: ftp or sftp
+deployer: ftp
+
 # Connection settings for deployment target (FTP only)
 ftp:
   host: <enter host id / ip address>
   port: <enter port - usually 21 for FTP over TLS>
   user: <enter user id>
-  pwd: <enter password>
+  # Password. Better left out of this file - see the README for the
+  # alternatives (--ftppwd, HUGODEPLOY_FTP_PWD, ~/.netrc, pwd_command, keyring)
+  #pwd: <enter password>
+  #pwd_command: <command that prints the password, e.g. pass show web/ftp>
   rootdir: <enter root directory of website, e.g. /public_html/>
-	disabletls: false
+  disabletls: false
 
 # Connection settings for deployment target (SFTP only)
 sftp:
   host: <enter host id / ip address>
   port: <enter port - usually 22 for SSH>
   user: <enter user id>
-  pwd: <enter password>
+  # Password, as for ftp (--sftppwd, HUGODEPLOY_SFTP_PWD etc)
+  #pwd: <enter password>
   rootdir: <enter root directory of website, e.g. /public_html/>
+  # Server host key is checked against ~/.ssh/known_hosts by default
+  #knownhosts: <path to known_hosts file>
+
+# Location of files to publish. For hugo static sites this is PublishDir and
+# defaults to public. If this file sits alongside a Hugo site config, its
+# publishDir is used by default.
+#sourcedir: public
 
-# Location of files to publish. For hugo static sites this is PublishDir and defaults to public
-sourcedir: published
+# Public address of the website. Defaults to baseURL from the Hugo site config
+#baseurl: https://example.com/
 
 # Skip files or directories which match the following patterns
 skipfiles:
@@ -207,6 +221,64 @@ skipfiles:
   - .git
   - /tmp
 
+# Build the site before each push? Stops the push if the build fails. Skip
+# it for one push with --no-build. [Default false]
+#build: true
+# Command to build with, run through the shell in this file's directory.
+# HUGODEPLOY_SOURCEDIR holds sourcedir. [Default hugo --destination <sourcedir>]
+#buildcommand: hugo --minify --destination $HUGODEPLOY_SOURCEDIR
+
+# Shell commands to run around a push. They're given details of the push in
+# HUGODEPLOY_* environment variables. A failing pre_push stops the push.
+#hooks:
+#  pre_push: ssh web touch /var/www/maintenance
+#  post_push: ssh web rm /var/www/maintenance
+#  on_failure: ./notify-chat.sh "Deploy failed: $HUGODEPLOY_ERROR"
+
+# Write the URLs changed by each push to a file, and/or send them to a CDN
+# to purge from its cache. Needs baseurl
+#purge:
+#  urlfile: changed-urls.txt
+#  endpoint: https://api.cloudflare.com/client/v4/zones/<zone id>/purge_cache
+#  headers:
+#    - 'Authorization: Bearer {{env "CLOUDFLARE_API_TOKEN"}}'
+#  body: '{"files": {{json .URLs}}}'
+#  batchsize: 30
+
+# Check the live site after each push. Each of urls must load, and a sample
+# of the pages just sent must be served exactly as uploaded. Needs baseurl
+#smoke:
+#  urls:
+#    - /
+#  sample: 5
+
+# Size limits, e.g. 300KB, 1.5MB or 2GB, optionally followed by warn (go ahead
+# with a warning) or fail (deploy nothing - the default). files rules are a
+# pattern then a limit and replace maxfilesize for the files they match.
+# types rules are a media type then a limit. total limits one push
+#budgets:
+#  maxfilesize: 20MB
+#  files:
+#    - "downloads/** 200MB"
+#  types:
+#    - "text/javascript 300KB warn"
+#    - "image/* 2MB warn"
+#  total: 500MB warn
+
+# Push takes a lock in deployRecordDir so two pushes can't run at once. Set
+# remote to lock the target too, when pushing from more than one machine.
+# Locks older than staleafter are taken over (0 for never) [Default 2h]
+#lock:
+#  remote: true
+#  staleafter: 2h
+
+# Keep the record of what has been deployed on the server, as
+# .hugodeploy-manifest.json in the website root, rather than in
+# deployRecordDir, so any machine or CI runner can push just the changes.
+# Also locks the server as lock: remote does [Default false]
+#manifest:
+#  remote: true
+
 # Location of directory used for tracking what has been deployed
 deployRecordDir: deployed
 
@@ -215,6 +287,40 @@ deployRecordDir: deployed
 
 # Disable minification? [Default false]
 #DontMinify: true
+
+# Check each upload arrived intact, resending up to verifyretries times if not? [Default false]
+#verify: true
+#verifyretries: 2
+
+# Check for broken links and missing assets before each push, and push
+# nothing if any are found? [Default false]
+#strict: true
+
+# Permissions to set on the server, as a pattern then an octal mode. Later
+# rules win. Without a rule the server's default applies.
+#permissions:
+#  - "cgi-bin/** 0755"
+#  - "*.sh 0700"
+
+# Give uploaded files the same modification time as the source? [Default false]
+#preservemodtime: true
+
+# What to do with symbolic links in sourcedir: follow them and deploy what
+# they point to, skip them, or preserve them as links on the server (SFTP
+# only). [Default follow]
+#symlinks: follow
+
+# Named environments, selected with --env. Each one overrides the settings
+# above and keeps its own deploy record (deployRecordDir/<name> by default).
+#environments:
+#  staging:
+#    ftp:
+#      rootdir: /staging/
+#  production:
+#    sourcedir: public
+#    skipfiles:
+#      - .DS_Store
+#      - drafts
 `
 	err = writeStringToFile(path, filename, template)
 	if err != nil {
@@ -15,6 +15,9 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/mindok/hugodeploy/deploy"
 	"github.com/spf13/cobra"
 	jww "github.com/spf13/jwalterweatherman"
@@ -27,6 +30,12 @@ var compareCmd = &cobra.Command{
 	Long: `Preview allows you to view the changes that would be applied by push.
 Preview uses the same comparison algorithms as push to determine what changes
 need to be applied and lists those changes.
+
+Any size budgets exceeded are listed too. Preview exits with a non-zero
+status if push would refuse to deploy because of them.
+
+With manifest.remote set, preview connects to your webhost to fetch the
+manifest of what has been deployed, but changes nothing there.
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
 		checkSourcePath()
@@ -34,15 +43,37 @@ need to be applied and lists those changes.
 		checkDeployPath()
 		jww.INFO.Println("Preview: Deploy Record Dir Good: ", Deploy)
 
-		deploy.DeployChanges(Source, Deploy, !UnMinify, previewDeployCommandHandler, SkipFiles)
+		opts := deployOptions()
+		if opts.RemoteManifest {
+			// Needed to fetch the manifest
+			target, err := newDeployer()
+			if err != nil {
+				er(err)
+			}
+			opts.Deployer = target
+		}
+		plan, err := deploy.MakePlan(context.Background(), opts)
+		if err != nil {
+			er(err)
+		}
+		for _, c := range plan.Commands {
+			jww.FEEDBACK.Println("Command: ", c.GetCommandDesc(), " : ", c.RelPath)
+		}
+		failed := 0
+		for _, v := range plan.Violations {
+			jww.FEEDBACK.Println("Budget: ", v)
+			if v.Fail {
+				failed++
+			}
+		}
+		if failed > 0 {
+			er(fmt.Sprintf("%d size budgets exceeded - push won't deploy anything until they are fixed", failed))
+		}
 	},
 }
 
-func previewDeployCommandHandler(cmd *deploy.DeployCommand) error {
-	jww.FEEDBACK.Println("Command: ", cmd.GetCommandDesc(), " : ", cmd.RelPath)
-	return nil
-}
-
 func init() {
 	RootCmd.AddCommand(compareCmd)
+	// Preview connects to fetch a remote manifest
+	initPasswordFlags(compareCmd)
 }
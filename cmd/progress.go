@@ -0,0 +1,195 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mindok/hugodeploy/deploy"
+	"golang.org/x/term"
+)
+
+const progressRedraw = 100 * time.Millisecond // Minimum time between progress bar redraws
+const progressPlainEvery = 10 * time.Second   // Time between progress lines when not on a terminal
+const progressBarWidth = 30
+
+// progress is an Observer that shows how far through a push we are. On a
+// terminal it keeps a progress bar on the last line, redrawing it under any
+// log output written through it. Elsewhere it prints a plain line every so
+// often. Either way it finishes with a summary of what was done.
+type progress struct {
+	mu         sync.Mutex
+	out        io.Writer
+	tty        bool
+	filesTotal int
+	filesDone  int
+	bytesTotal int64
+	bytesDone  int64
+	start      time.Time
+	lastDraw   time.Time
+	drawn      bool
+}
+
+func newProgress(out io.Writer) *progress {
+	p := &progress{out: out}
+	if f, ok := out.(*os.File); ok {
+		p.tty = term.IsTerminal(int(f.Fd()))
+	}
+	return p
+}
+
+// Write passes log output through, keeping the progress bar below it
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	n, err := p.out.Write(b)
+	if p.drawn {
+		p.draw()
+	}
+	return n, err
+}
+
+func (p *progress) Notify(ev *deploy.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch ev.Type {
+	case deploy.EVENT_SCAN_FINISH:
+		// Start afresh, as push --watch deploys many times
+		p.filesTotal, p.filesDone, p.bytesTotal, p.bytesDone = 0, 0, 0, 0
+		p.lastDraw = time.Time{}
+		for _, cmd := range ev.Plan.Commands {
+			p.filesTotal++
+			p.bytesTotal += cmd.Size
+		}
+		p.start = ev.Time
+		return
+	case deploy.EVENT_COMMAND_SUCCESS, deploy.EVENT_COMMAND_FAILURE:
+		p.filesDone++
+	case deploy.EVENT_BYTES_TRANSFERRED:
+		p.bytesDone += ev.Bytes
+	case deploy.EVENT_SUMMARY:
+		p.clear()
+		p.drawn = false
+		p.summarise(ev.Summary)
+		return
+	default:
+		return
+	}
+
+	if p.filesTotal == 0 {
+		return
+	}
+	if p.tty {
+		if p.filesDone == p.filesTotal || ev.Time.Sub(p.lastDraw) >= progressRedraw {
+			p.clear()
+			p.draw()
+			p.drawn = true
+			p.lastDraw = ev.Time
+		}
+	} else if ev.Time.Sub(p.lastDraw) >= progressPlainEvery || p.filesDone == p.filesTotal {
+		if !p.lastDraw.IsZero() || p.filesDone == p.filesTotal {
+			fmt.Fprintln(p.out, "Progress:", p.status())
+		}
+		p.lastDraw = ev.Time
+	}
+}
+
+// clear removes the progress bar so something else can be written in its place
+func (p *progress) clear() {
+	if p.tty && p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+}
+
+func (p *progress) draw() {
+	done := progressBarWidth * p.filesDone / p.filesTotal
+	if p.bytesTotal > 0 {
+		done = int(int64(progressBarWidth) * p.bytesDone / p.bytesTotal)
+	}
+	if done > progressBarWidth {
+		done = progressBarWidth
+	}
+	bar := strings.Repeat("=", done) + strings.Repeat(" ", progressBarWidth-done)
+	fmt.Fprintf(p.out, "[%s] %s", bar, p.status())
+}
+
+// status describes files and bytes done, throughput and time remaining
+func (p *progress) status() string {
+	s := fmt.Sprintf("%d/%d files, %s/%s", p.filesDone, p.filesTotal, formatBytes(p.bytesDone), formatBytes(p.bytesTotal))
+	elapsed := time.Since(p.start)
+	if elapsed < time.Second || p.filesDone == 0 {
+		return s
+	}
+	rate := float64(p.bytesDone) / elapsed.Seconds()
+	s += fmt.Sprintf(", %s/s", formatBytes(int64(rate)))
+
+	// Estimate from bytes where there are any, otherwise from commands, as
+	// directory and delete commands take time but send nothing
+	var left time.Duration
+	if p.bytesTotal > 0 && rate > 0 {
+		left = time.Duration(float64(p.bytesTotal-p.bytesDone) / rate * float64(time.Second))
+	} else {
+		left = elapsed * time.Duration(p.filesTotal-p.filesDone) / time.Duration(p.filesDone)
+	}
+	if p.filesDone < p.filesTotal {
+		s += ", ETA " + left.Round(time.Second).String()
+	}
+	return s
+}
+
+func (p *progress) summarise(s *deploy.Summary) {
+	if len(s.Commands) == 0 && s.Failed == 0 {
+		return
+	}
+	counts := []string{}
+	for cmd, n := range s.Commands {
+		counts = append(counts, fmt.Sprintf("%s: %d", (&deploy.DeployCommand{Command: cmd}).GetCommandDesc(), n))
+	}
+	sort.Strings(counts)
+	if s.Failed > 0 {
+		counts = append(counts, fmt.Sprintf("FAILED: %d", s.Failed))
+	}
+	if s.Retries > 0 {
+		counts = append(counts, fmt.Sprintf("RESENT: %d", s.Retries))
+	}
+	fmt.Fprintln(p.out, "Summary:", strings.Join(counts, ", "))
+	line := fmt.Sprintf("Transferred %s in %v", formatBytes(s.BytesTransferred), s.Elapsed.Round(time.Millisecond))
+	if s.BytesSaved > 0 {
+		line += ". Minification saved " + formatBytes(s.BytesSaved)
+	}
+	fmt.Fprintln(p.out, line)
+}
+
+// formatBytes gives a byte count in human readable units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,176 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mindok/hugodeploy/deploy"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+)
+
+// purgeDefaultBody suits Cloudflare's purge_cache API
+const purgeDefaultBody = `{"files": {{json .URLs}}}`
+const purgeDefaultBatch = 30
+const purgeTimeout = 30 * time.Second
+
+// purger collects the URLs changed by a push and, when it finishes, writes
+// them to purge.urlfile and/or sends them to purge.endpoint so a CDN can
+// drop its cached copies. Only commands that succeeded count, so a failed
+// push still purges what it did change.
+type purger struct {
+	done []*deploy.DeployCommand
+	err  error // Set if purging failed
+}
+
+// purgeEnabled reports whether anything is to be done with changed URLs
+func purgeEnabled() bool {
+	return viper.GetString("purge.urlfile") != "" || viper.GetString("purge.endpoint") != ""
+}
+
+func (p *purger) Notify(ev *deploy.Event) {
+	switch ev.Type {
+	case deploy.EVENT_COMMAND_SUCCESS:
+		p.done = append(p.done, ev.Command)
+	case deploy.EVENT_SUMMARY:
+		done := p.done
+		p.done = nil
+		if len(done) == 0 {
+			return
+		}
+		if err := purgeURLs(done); err != nil {
+			jww.ERROR.Println(err)
+			p.err = err
+		}
+	}
+}
+
+// purgeData is what the purge.headers and purge.body templates are given
+type purgeData struct {
+	URLs    []string
+	BaseURL string
+	Token   string
+}
+
+var purgeFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// env reads an environment variable, e.g. for an API token. The value is
+	// treated as a secret
+	"env": func(name string) string {
+		v := os.Getenv(name)
+		deploy.RegisterSecret(v)
+		return v
+	},
+}
+
+func purgeURLs(cmds []*deploy.DeployCommand) error {
+	urls, err := deploy.ChangedURLs(viper.GetString("baseurl"), cmds)
+	if err != nil {
+		return fmt.Errorf("purge: %v", err)
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+
+	if file := viper.GetString("purge.urlfile"); file != "" {
+		if err := ioutil.WriteFile(file, []byte(strings.Join(urls, "\n")+"\n"), 0644); err != nil {
+			return fmt.Errorf("purge: can't write URL list: %v", err)
+		}
+		jww.FEEDBACK.Println("Changed URLs written to ", file)
+	}
+
+	if viper.GetString("purge.endpoint") == "" {
+		return nil
+	}
+	batch := viper.GetInt("purge.batchsize")
+	if batch <= 0 {
+		batch = len(urls)
+	}
+	for start := 0; start < len(urls); start += batch {
+		end := start + batch
+		if end > len(urls) {
+			end = len(urls)
+		}
+		if err := sendPurge(urls[start:end]); err != nil {
+			return fmt.Errorf("purge: %v", err)
+		}
+	}
+	jww.FEEDBACK.Println("Purged ", len(urls), " URLs from the cache")
+	return nil
+}
+
+// sendPurge makes one request to purge.endpoint for urls
+func sendPurge(urls []string) error {
+	data := purgeData{URLs: urls, BaseURL: viper.GetString("baseurl"), Token: viper.GetString("purge.token")}
+	deploy.RegisterSecret(data.Token)
+
+	body, err := expandPurgeTemplate("purge.body", viper.GetString("purge.body"), data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(viper.GetString("purge.method"), viper.GetString("purge.endpoint"), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, h := range viper.GetStringSlice("purge.headers") {
+		line, err := expandPurgeTemplate("purge.headers", h, data)
+		if err != nil {
+			return err
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return fmt.Errorf("purge.headers entry %q should look like Name: value", h)
+		}
+		req.Header.Set(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+	}
+
+	jww.INFO.Println("Purging ", len(urls), " URLs: ", req.Method, " ", req.URL)
+	resp, err := (&http.Client{Timeout: purgeTimeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s replied %s: %s", req.URL.Host, resp.Status, bytes.TrimSpace(reply))
+	}
+	jww.DEBUG.Println("Purge reply: ", string(reply))
+	return nil
+}
+
+func expandPurgeTemplate(key, text string, data purgeData) (string, error) {
+	t, err := template.New(key).Funcs(purgeFuncs).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", key, err)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("%s: %v", key, err)
+	}
+	return b.String(), nil
+}
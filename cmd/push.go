@@ -15,54 +15,225 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
 	"github.com/mindok/hugodeploy/deploy"
 	"github.com/spf13/cobra"
 	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
 )
 
 // pushCmd represents the push command
 var pushCmd = &cobra.Command{
 	Use:   "push",
 	Short: "Deploy changes website updates to host",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Long: `Push works out what has changed between sourceDir and deployRecordDir
+(the record of what has already been deployed) and sends those changes to
+the deployment target. Each change is recorded in deployRecordDir once the
+target has accepted it, so an interrupted push can simply be run again.
+
+Press Ctrl-C to stop a push cleanly after the current file.
+
+With --json, progress is written to stdout as one JSON object per line for
+CI systems and other tools to consume. Log output moves to stderr.
+
+A progress bar shows files and bytes sent, throughput and time remaining
+when output is to a terminal; otherwise a progress line is printed every few
+seconds. A summary of what was done is printed at the end.
+
+With --verify (or verify: true in the config file) each upload is checked
+against what was sent - by size, then by checksum where the server supports
+one, or by downloading small files again - and resent up to verifyRetries
+times if it doesn't match. Only verified files are recorded as deployed.
+
+With --watch, push keeps running after the first deployment and deploys
+again whenever sourceDir changes - handy alongside hugo --watch. Changes are
+gathered until none have arrived for --debounce, then just the directory
+holding them is compared and sent. The connection stays open in between.
+
+With build: true in the config file, push builds the site first by running
+buildcommand (hugo --destination sourceDir if not set) and stops if the build
+fails. --no-build skips the build for one push.
+
+Shell commands set in the hooks section of the config file run around the
+push: pre_push before connecting (the push stops if it fails), post_push
+after a successful push and on_failure after a failed one, whatever the
+reason. With manifest.remote, pre_push runs after connecting, as the
+manifest on the target is needed to know what there is to deploy.
+
+With purge.urlfile or purge.endpoint set, the public URLs of the files
+changed are written to a file or sent to a CDN's purge API once the push is
+done.
+
+With smoke.urls or smoke.sample set, the live site is checked once the push
+is done: each of smoke.urls must load, and a sample of the pages just sent
+must be served exactly as uploaded. If not, the push fails.
+
+With --strict (or strict: true in the config file) push first checks sourceDir
+for broken links and missing assets, as hugodeploy check does, and pushes
+nothing if any are found.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+A lock file in deployRecordDir stops two pushes from running at once, and
+with lock.remote set another on the target stops pushes from different
+machines clashing. Locks left by a push that crashed are taken over once the
+process has gone or after lock.staleafter. --force-unlock removes them
+straight away.
+
+With manifest.remote set, the record of what has been deployed is kept on
+the target as .hugodeploy-manifest.json (paths, sizes and hashes) instead of
+in deployRecordDir, so any machine or CI runner can push just the changes.
+It is downloaded before comparing and uploaded again at the end, and the
+target is locked as with lock.remote.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if cmd.Flags().Lookup("verify").Changed {
+			viper.Set("verify", VerifyUploads)
+		}
+		if cmd.Flags().Lookup("strict").Changed {
+			viper.Set("strict", Strict)
+		}
+		mustValidateConfig()
+		h := newHooks()
+		if viper.GetBool("build") && !NoBuild {
+			if err := runBuild(viper.GetString("sourceDir")); err != nil {
+				h.fail(err)
+			}
+		}
 		checkSourcePath()
 		jww.INFO.Println("Push: Source Dir Good: ", Source)
 		checkDeployPath()
 		jww.INFO.Println("Push: Deploy Record Dir Good: ", Deploy)
 
-		var err error
-
-		ftpDeployer = &deploy.FTPDeployer{}
-		if err = ftpDeployer.Initialise(); err != nil {
-			panic(err)
+		target, err := newDeployer()
+		if err != nil {
+			h.fail(err)
 		}
 
-		deployRecorder = &deploy.FileDeployer{Deploy}
-		deployRecorder.Initialise()
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
 
-		deploy.DeployChanges(Source, Deploy, !UnMinify, pushDeployCommandHandler, SkipFiles)
+		if viper.GetBool("strict") {
+			if err := checkLinks(ctx); err != nil {
+				h.fail(fmt.Errorf("%v. Nothing was pushed - run hugodeploy check for details", err))
+			}
+		}
 
-		ftpDeployer.Cleanup()
-		deployRecorder.Cleanup()
+		opts := deployOptions()
+		opts.Deployer = target
+		if !NoProgress {
+			prog := newProgress(logOutput())
+			deploy.RedactLogging(prog)
+			opts.Observers = append(opts.Observers, prog)
+		}
+		if JSONEvents {
+			opts.Observers = append(opts.Observers, deploy.NewJSONObserver(os.Stdout))
+		}
+		purge := &purger{}
+		if purgeEnabled() {
+			opts.Observers = append(opts.Observers, purge)
+		}
+		if smokeEnabled() {
+			opts.AfterApply = smokeTest
+		}
+		opts.BeforeConnect = h.beforeConnect
+		opts.Observers = append(opts.Observers, h)
+		if Watch {
+			err = deploy.Watch(ctx, opts, WatchDebounce)
+		} else {
+			err = deploy.Run(ctx, opts)
+		}
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				h.fail("push cancelled. Run push again to send the remaining changes")
+			}
+			var locked *deploy.LockedError
+			if errors.As(err, &locked) {
+				h.fail(fmt.Sprintf("%v. If that push is no longer running, use --force-unlock", err))
+			}
+			h.fail(err)
+		}
+		if purge.err != nil {
+			er(purge.err)
+		}
+		if h.err != nil {
+			er(h.err)
+		}
 	},
 }
 
-var ftpDeployer *deploy.FTPDeployer
-var deployRecorder *deploy.FileDeployer
+var FtpPwd, SftpPwd string
+var JSONEvents, NoProgress, VerifyUploads, Watch, NoBuild, Strict, ForceUnlock bool
+var WatchDebounce time.Duration
+
+// deployOptions gathers the settings used by the deploy package
+func deployOptions() deploy.Options {
+	return deploy.Options{
+		SourceDir: Source,
+		RecordDir: Deploy,
+		Minify:    !viper.GetBool("dontminify"),
+		SkipFiles: SkipFiles,
+
+		Verify:        viper.GetBool("verify"),
+		VerifyRetries: viper.GetInt("verifyretries"),
+
+		Permissions:     viper.GetStringSlice("permissions"),
+		PreserveModTime: viper.GetBool("preservemodtime"),
+		Symlinks:        viper.GetString("symlinks"),
+		Budgets:         deployBudgets(),
+
+		RemoteLock:   viper.GetBool("lock.remote"),
+		StaleLockAge: staleLockAge(),
+		ForceUnlock:  ForceUnlock,
+
+		RemoteManifest: viper.GetBool("manifest.remote"),
+	}
+}
 
-func pushDeployCommandHandler(cmd *deploy.DeployCommand) error {
-	err := ftpDeployer.ApplyCommand(cmd)
-	//err := deployRecorder.ApplyCommand(cmd)
-	if err == nil {
-		err = deployRecorder.ApplyCommand(cmd)
+// staleLockAge reads lock.staleafter, where 0 means locks never go stale
+func staleLockAge() time.Duration {
+	age, err := time.ParseDuration(viper.GetString("lock.staleafter"))
+	if err != nil {
+		return 0 // The default. Config validation reports the error
 	}
-	return err
+	if age == 0 {
+		return -1
+	}
+	return age
+}
+
+// deployBudgets gathers the budgets section of the config file
+func deployBudgets() deploy.Budgets {
+	return deploy.Budgets{
+		MaxFileSize: viper.GetString("budgets.maxfilesize"),
+		Files:       viper.GetStringSlice("budgets.files"),
+		Types:       viper.GetStringSlice("budgets.types"),
+		Total:       viper.GetString("budgets.total"),
+	}
+}
+
+// newDeployer creates the deployment target selected by the deployer option,
+// passing on any password given on the command line
+func newDeployer() (deploy.Deployer, error) {
+	d, err := deploy.NewDeployer(viper.GetString("deployer"))
+	if err != nil {
+		return nil, err
+	}
+	switch t := d.(type) {
+	case *deploy.FTPDeployer:
+		t.PWD = FtpPwd
+	case *deploy.SFTPDeployer:
+		t.PWD = SftpPwd
+	}
+	return d, nil
+}
+
+func initPasswordFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&FtpPwd, "ftppwd", "", "FTP Password. Avoids having to set it in config file")
+	cmd.PersistentFlags().StringVar(&SftpPwd, "sftppwd", "", "SFTP Password. Avoids having to set it in config file")
 }
 
 func init() {
@@ -72,10 +243,17 @@ func init() {
 
 	// Cobra supports Persistent Flags which will work for this command
 	// and all subcommands, e.g.:
-	pushCmd.PersistentFlags().String("ftppwd", "", "FTP Password. Avoids having to set it in config file")
+	initPasswordFlags(pushCmd)
 
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
-	// pushCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	pushCmd.Flags().BoolVar(&VerifyUploads, "verify", false, "Check each upload arrived intact, resending if not")
+	pushCmd.Flags().BoolVar(&NoProgress, "no-progress", false, "Don't show progress or the end of run summary")
+	pushCmd.Flags().BoolVar(&JSONEvents, "json", false, "Write progress events to stdout as JSON lines")
+	pushCmd.Flags().BoolVar(&ForceUnlock, "force-unlock", false, "Remove locks left by another push first. Only use if no other push is running")
+	pushCmd.Flags().BoolVar(&Strict, "strict", false, "Don't push if sourceDir has broken links or missing assets")
+	pushCmd.Flags().BoolVar(&NoBuild, "no-build", false, "Don't build the site first, even if build is set in the config file")
+	pushCmd.Flags().BoolVar(&Watch, "watch", false, "Keep running, deploying again whenever sourceDir changes")
+	pushCmd.Flags().DurationVar(&WatchDebounce, "debounce", time.Second, "With --watch, wait this long after the last change before deploying")
 
 }
@@ -0,0 +1,177 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mindok/hugodeploy/deploy"
+	"github.com/mindok/hugodeploy/deploy/ftptest"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const testSecret = "s3cr3t-Pa55word"
+
+// TestPushNeverPrintsPassword pushes to a test FTP server at each verbosity,
+// with the password in the config file, and checks it isn't in anything
+// printed - the config listing, the FTP library's debug trace of the login
+// or the JSON events.
+func TestPushNeverPrintsPassword(t *testing.T) {
+	cases := []struct {
+		name   string
+		args   []string
+		listed bool // The config listing is printed, with the password masked
+	}{
+		{"default", nil, false},
+		{"verbose", []string{"-v"}, true},
+		{"debug", []string{"-d"}, true},
+		{"json", []string{"--json"}, false},
+		{"json debug", []string{"--json", "-d"}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, err := ftptest.NewServer(ftptest.Quirks{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			srv.Password = testSecret
+			if err := srv.Fs.MkdirAll("/www", 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := t.TempDir()
+			cfg := writeTestSite(t, dir, fmt.Sprintf(`deployer: ftp
+sourcedir: public
+deployrecorddir: deployed
+ftp:
+  host: %s
+  port: %s
+  user: %s
+  pwd: %s
+  rootdir: /www
+`, srv.Host(), srv.Port(), srv.User, testSecret))
+
+			out := captureOutput(t, func() {
+				runRoot(t, append([]string{"push", "--config", cfg, "--no-progress"}, c.args...))
+			})
+
+			if strings.Contains(out, testSecret) {
+				t.Errorf("password printed:\n%s", out)
+			}
+			if !strings.Contains(strings.Join(srv.Commands(), "\n"), "STOR /www/index.html") {
+				t.Errorf("push didn't upload index.html. Server saw %v\nOutput:\n%s", srv.Commands(), out)
+			}
+			if masked := "ftp.pwd : " + deploy.RedactedMask; c.listed && !strings.Contains(out, masked) {
+				t.Errorf("expected %q in the config listing, got:\n%s", masked, out)
+			}
+		})
+	}
+}
+
+// TestConfigRedact checks config show --effective masks every secret
+// setting, not just passwords
+func TestConfigRedact(t *testing.T) {
+	cfg := &Config{}
+	cfg.FTP.Pwd = testSecret
+	cfg.SFTP.Pwd = testSecret
+	cfg.Purge.Token = testSecret
+	cfg.FTP.User = "me"
+	cfg.redact()
+
+	for name, got := range map[string]string{"ftp.pwd": cfg.FTP.Pwd, "sftp.pwd": cfg.SFTP.Pwd, "purge.token": cfg.Purge.Token} {
+		if got != deploy.RedactedMask {
+			t.Errorf("%s: got %q, want it masked", name, got)
+		}
+	}
+	if cfg.FTP.User != "me" {
+		t.Errorf("ftp.user: got %q, want it left alone", cfg.FTP.User)
+	}
+}
+
+// writeTestSite creates a config file, a source directory with one page and
+// an empty deploy record in dir, returning the config file's path
+func writeTestSite(t *testing.T, dir, config string) string {
+	t.Helper()
+	for _, d := range []string{"public", "deployed"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "public", "index.html"), []byte("<html><body>Hello</body></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := filepath.Join(dir, "hugodeploy.yaml")
+	if err := os.WriteFile(cfg, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// runRoot runs hugodeploy with args, starting from a clean configuration
+// as each run of the program would
+func runRoot(t *testing.T, args []string) {
+	t.Helper()
+	viper.Reset()
+	jww.SetStdoutThreshold(jww.LevelError)
+	resetFlags(RootCmd.PersistentFlags(), "config", "verbose", "debug")
+	resetFlags(pushCmd.Flags(), "json", "no-progress", "no-build")
+	RootCmd.SetArgs(args)
+	if err := RootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// resetFlags puts the named flags back to their defaults, unset
+func resetFlags(flags *pflag.FlagSet, names ...string) {
+	for _, name := range names {
+		f := flags.Lookup(name)
+		f.Value.Set(f.DefValue)
+		f.Changed = false
+	}
+}
+
+// captureOutput runs fn and returns everything it wrote to stdout and stderr
+func captureOutput(t *testing.T, fn func()) string {
+	t.Helper()
+	stdout, stderr := os.Stdout, os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout, os.Stderr = w, w
+	var buf bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		io.Copy(&buf, r)
+		close(done)
+	}()
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		r.Close()
+	}()
+	fn()
+	w.Close()
+	<-done
+	return buf.String()
+}
@@ -16,8 +16,11 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 
+	"github.com/mindok/hugodeploy/deploy"
 	"github.com/spf13/cobra"
 	jww "github.com/spf13/jwalterweatherman"
 	"github.com/spf13/viper"
@@ -26,10 +29,10 @@ import (
 // This represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "hugodeploy",
-	Short: "HugoDeploy deploys files to a webserver using SFTP",
+	Short: "HugoDeploy deploys files to a webserver using FTP or SFTP",
 	Long: `HugoDeploy tracks changes made to a local directory and
-transfers those changes to a remote server. Currently the transfer
-is done using SFTP.
+transfers those changes to a remote server. The transfer is done
+using FTP (optionally over TLS) or SFTP.
 
 HugoDeploy can generate a list of changed files using the preview
 command and does the actual transfer using the push command.
@@ -48,7 +51,7 @@ expected in the directory HugoDeploy is executed from.`,
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(logOutput(), deploy.Redact(err.Error()))
 		os.Exit(-1)
 	}
 }
@@ -60,7 +63,7 @@ func init() {
 	initCoreCommonFlags(RootCmd)
 }
 
-var CfgFile, Source, Deploy string
+var CfgFile, Source, Deploy, Env string
 var Verbose, Debug, UnMinify bool
 var SkipFiles []string
 
@@ -68,6 +71,7 @@ func initCoreCommonFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().StringVar(&CfgFile, "config", "", "config file (default is path/hugodeploy.yaml|json|toml)")
 	cmd.PersistentFlags().BoolVarP(&Verbose, "verbose", "v", false, "verbose output")
 	cmd.PersistentFlags().BoolVarP(&Debug, "debug", "d", false, "debug trace output")
+	cmd.PersistentFlags().StringVarP(&Env, "env", "e", "", "named environment from the config file to deploy to (e.g. staging, production)")
 	//cmd.PersistentFlags().BoolVar(&Logging, "log", false, "Enable Logging")
 	//cmd.PersistentFlags().StringVar(&LogFile, "logFile", "", "Log File path (if set, logging enabled automatically)")
 	//cmd.PersistentFlags().BoolVar(&VerboseLog, "verboseLog", false, "verbose logging")
@@ -78,37 +82,57 @@ func initCoreCommonFlags(cmd *cobra.Command) {
 }
 
 func LoadDefaultSettings() {
-	viper.SetDefault("sourceDir", "publish")
+	viper.SetDefault("sourceDir", "public")
 	viper.SetDefault("deployRecordDir", "deployed")
+	viper.SetDefault("deployer", "ftp")
+	viper.SetDefault("ftp.port", deploy.FTP_DEFAULT_PORT)
+	viper.SetDefault("sftp.port", deploy.SFTP_DEFAULT_PORT)
 	viper.SetDefault("dontminify", false)
 	viper.SetDefault("verbose", false)
 	viper.SetDefault("debug", false)
 	viper.SetDefault("skipfiles", []string{".git*", ".DS_Store"})
+	viper.SetDefault("verify", false)
+	viper.SetDefault("verifyretries", 2)
+	viper.SetDefault("strict", false)
+	viper.SetDefault("lock.remote", false)
+	viper.SetDefault("lock.staleafter", deploy.DefaultStaleLockAge.String())
+	viper.SetDefault("manifest.remote", false)
+	viper.SetDefault("symlinks", deploy.SYMLINKS_FOLLOW)
+	viper.SetDefault("build", false)
+	viper.SetDefault("purge.method", "POST")
+	viper.SetDefault("purge.body", purgeDefaultBody)
+	viper.SetDefault("purge.batchsize", purgeDefaultBatch)
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
+	// Mask passwords etc in everything we (and the ftp library) print
+	deploy.RedactLogging(logOutput())
 
 	if CfgFile != "" { // enable ability to specify config file via flag
 		viper.SetConfigFile(CfgFile)
+	} else {
+		viper.SetConfigName("hugodeploy") // name of config file (without extension)
+		viper.AddConfigPath(".")          // adding cwd directory as first search path
 	}
-
-	viper.SetConfigName("hugodeploy") // name of config file (without extension)
-	viper.AddConfigPath(".")          // adding cwd directory as first search path
 	//viper.AddConfigPath("/Users/johnjessop/Documents/Code/GoCode/src/github.com/mindok/hugodeploy")
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
 
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
-	} else {
-		fmt.Println("Error: No valid config file found. ", err)
-		//os.Exit(-1)
+	configErr := viper.ReadInConfig()
+	if configErr == nil {
+		fmt.Fprintln(logOutput(), "Using config file:", viper.ConfigFileUsed())
+	} else if _, ok := configErr.(viper.ConfigParseError); ok {
+		fmt.Fprintln(logOutput(), "Error: Config file could not be read. Run hugodeploy config validate for details. ", configErr)
 	}
 
 	LoadDefaultSettings()
 
+	if Env != "" {
+		applyEnvironment(Env)
+	}
+
 	if RootCmd.PersistentFlags().Lookup("verbose").Changed {
 		viper.Set("Verbose", Verbose)
 	}
@@ -132,18 +156,90 @@ func initConfig() {
 	if viper.GetBool("debug") {
 		jww.SetStdoutThreshold(jww.LevelTrace)
 	}
+	deploy.RedactLogging(logOutput())
 
+	hugoFound := loadHugoDefaults()
+	if _, ok := configErr.(viper.ConfigParseError); configErr != nil && !ok {
+		if hugoFound {
+			fmt.Fprintln(logOutput(), "No hugodeploy config file found - using the Hugo site config")
+		} else {
+			fmt.Fprintln(logOutput(), "Error: No valid config file found. ", configErr)
+			//os.Exit(-1)
+		}
+	}
+
+	resolvePaths()
 	SkipFiles = viper.GetStringSlice("skipfiles")
 
 	jww.INFO.Println("Listing Config:")
 	for _, x := range viper.AllKeys() {
-		jww.INFO.Println(x, ":", viper.Get(x))
+		jww.INFO.Println(x, ":", deploy.RedactSetting(x, viper.Get(x)))
+	}
+
+}
+
+// pathSettings are the settings holding file or directory paths
+var pathSettings = []string{"sourceDir", "deployRecordDir", "sftp.knownhosts", "purge.urlfile"}
+
+// resolvePaths makes every path setting absolute so the rest of hugodeploy
+// needn't care where it was run from. Paths given as flags are relative to
+// the current directory; all others, including defaults, are relative to the
+// directory holding the config file (the current directory if there isn't one).
+func resolvePaths() {
+	base := "."
+	if f := viper.ConfigFileUsed(); f != "" {
+		base = filepath.Dir(f)
+	}
+	for _, key := range pathSettings {
+		p := viper.GetString(key)
+		if p == "" {
+			continue
+		}
+		if f := RootCmd.PersistentFlags().Lookup(key); (f == nil || !f.Changed) && !filepath.IsAbs(p) {
+			p = filepath.Join(base, p)
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			er(fmt.Sprintf("can't resolve %s %s: %v", key, p, err))
+		}
+		if abs != p {
+			jww.DEBUG.Println("Resolved ", key, " to ", abs)
+		}
+		viper.Set(key, abs)
 	}
+}
 
+// logOutput is where progress messages go. It's stdout unless stdout is
+// reserved for machine readable output.
+func logOutput() io.Writer {
+	if JSONEvents {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// applyEnvironment overlays the settings in environments.<name> on top of the
+// base settings. Unless the environment nominates its own deployRecordDir, each
+// environment gets a subdirectory of the base one so switching environments
+// doesn't force a full re-upload.
+func applyEnvironment(name string) {
+	key := "environments." + name
+	if !viper.IsSet(key) {
+		er(fmt.Sprintf("environment %q not found in config file (expected %s)", name, key))
+	}
+	jww.INFO.Println("Using environment: ", name)
+
+	env := viper.Sub(key)
+	for _, k := range env.AllKeys() {
+		jww.DEBUG.Println("Environment override: ", k)
+		viper.Set(k, env.Get(k))
+	}
+	if !env.IsSet("deployRecordDir") {
+		viper.Set("deployRecordDir", filepath.Join(viper.GetString("deployRecordDir"), name))
+	}
 }
 
 func checkSourcePath() {
-	//TODO: Need to do some fancy path fixing for relative paths etc
 	Source = viper.GetString("sourceDir")
 	jww.INFO.Println("Checking Source Dir exists: ", Source)
 	b, err := exists(Source)
@@ -164,6 +260,12 @@ func checkDeployPath() {
 	if err != nil {
 		er(err)
 	}
+	if !b && viper.GetBool("manifest.remote") {
+		// The manifest on the target is used instead
+		jww.INFO.Println("Deploy Dir does not exist - using the manifest on the target")
+		Deploy = ""
+		return
+	}
 	if !b {
 		jww.CRITICAL.Println("Deploy Dir does not exist", Deploy)
 		os.Exit(-1)
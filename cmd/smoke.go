@@ -0,0 +1,159 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mindok/hugodeploy/deploy"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+)
+
+const smokeTimeout = 30 * time.Second
+
+// smokeEnabled reports whether the live site is to be checked after a push
+func smokeEnabled() bool {
+	return len(viper.GetStringSlice("smoke.urls")) > 0 || viper.GetInt("smoke.sample") > 0
+}
+
+// smokeBaseURL is where the live site is checked: smoke.baseurl if set (e.g.
+// to go straight to the server rather than through a CDN), otherwise baseurl
+func smokeBaseURL() string {
+	if u := viper.GetString("smoke.baseurl"); u != "" {
+		return u
+	}
+	return viper.GetString("baseurl")
+}
+
+// smokeTest is used as deploy.Options.AfterApply. It fetches each of
+// smoke.urls, which must give a 2xx status, and smoke.sample of the pages
+// just sent, which must be served exactly as uploaded.
+func smokeTest(plan *deploy.Plan) error {
+	base := smokeBaseURL()
+	client := &http.Client{Timeout: smokeTimeout}
+	checks, failures := 0, 0
+	fail := func(u string, msg string) {
+		jww.ERROR.Println("Smoke test ", u, ": ", msg)
+		failures++
+	}
+
+	for _, u := range viper.GetStringSlice("smoke.urls") {
+		checks++
+		full, err := smokeURL(base, u)
+		if err != nil {
+			fail(u, err.Error())
+			continue
+		}
+		if _, err := smokeFetch(client, full); err != nil {
+			fail(full, err.Error())
+		}
+	}
+
+	for _, cmd := range smokeSample(plan.Commands, viper.GetInt("smoke.sample")) {
+		checks++
+		rel := filepath.ToSlash(cmd.RelPath)
+		if path.Base(rel) == "index.html" {
+			rel = strings.TrimSuffix(rel, "index.html")
+		}
+		full, err := deploy.PublicURL(base, rel)
+		if err != nil {
+			fail(rel, err.Error())
+			continue
+		}
+		sent, err := plan.SourceData(cmd)
+		if err != nil {
+			fail(full, err.Error())
+			continue
+		}
+		// Ask caches along the way for a fresh copy
+		served, err := smokeFetch(client, full+"?hugodeploy="+strconv.FormatInt(time.Now().Unix(), 10))
+		if err != nil {
+			fail(full, err.Error())
+			continue
+		}
+		if sha256.Sum256(served) != sha256.Sum256(sent) {
+			fail(full, fmt.Sprintf("served %d bytes that differ from the %d bytes uploaded", len(served), len(sent)))
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("smoke test failed: %d of %d checks failed", failures, checks)
+	}
+	if checks > 0 {
+		jww.FEEDBACK.Println("Smoke test passed: ", checks, " pages checked")
+	}
+	return nil
+}
+
+// smokeURL resolves u against base unless it is already a full address
+func smokeURL(base, u string) (string, error) {
+	if p, err := url.Parse(u); err == nil && p.IsAbs() {
+		return u, nil
+	}
+	return deploy.PublicURL(base, u)
+}
+
+// smokeFetch gets u, failing unless the status is 2xx
+func smokeFetch(client *http.Client, u string) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Cache-Control", "no-cache")
+	jww.INFO.Println("Smoke test fetching ", u)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	return body, nil
+}
+
+// smokeSample picks up to n of the HTML pages added or updated by cmds
+func smokeSample(cmds []*deploy.DeployCommand, n int) []*deploy.DeployCommand {
+	pages := []*deploy.DeployCommand{}
+	for _, cmd := range cmds {
+		ext := strings.ToLower(path.Ext(cmd.RelPath))
+		if cmd.IsFileCommand() && (ext == ".html" || ext == ".htm") {
+			pages = append(pages, cmd)
+		}
+	}
+	if n >= len(pages) {
+		return pages
+	}
+	sample := make([]*deploy.DeployCommand, n)
+	for i, j := range rand.Perm(len(pages))[:n] {
+		sample[i] = pages[j]
+	}
+	return sample
+}
@@ -0,0 +1,294 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+//What happens when a budget is exceeded
+const (
+	BUDGET_FAIL = "fail" //Nothing is deployed. The file isn't even read
+	BUDGET_WARN = "warn" //A warning is given and the file deployed as usual
+)
+
+//Budgets limits the size of what is deployed. Each limit is a size such as
+//"300KB" or "1.5MB" (see ParseSize), optionally followed by BUDGET_WARN or
+//BUDGET_FAIL, the default. Sizes are of the source files, before
+//minification.
+type Budgets struct {
+	MaxFileSize string   //Limit for any one file
+	Files       []string //Rules such as "video/** 500MB" - a pattern (see MatchGlob) then a limit. The last rule matching a file replaces MaxFileSize for it
+	Types       []string //Rules such as "text/javascript 300KB warn" - a media type, which may end in /*, then a limit. Applies as well as the file limit
+	Total       string   //Limit for all the files added or updated by one deployment
+}
+
+//BudgetViolation describes a budget that was exceeded
+type BudgetViolation struct {
+	RelPath string //The file over budget, or empty for the total
+	Rule    string //The budget, as written in the config file
+	Size    int64
+	Limit   int64
+	Fail    bool //False if the budget only warns
+}
+
+func (v BudgetViolation) String() string {
+	level := "warning"
+	if v.Fail {
+		level = "over budget"
+	}
+	what := "total deploy size"
+	if v.RelPath != "" {
+		what = strings.TrimPrefix(filepath.ToSlash(v.RelPath), "/")
+	}
+	return fmt.Sprintf("%s: %s is %s, more than %s (%s)", level, what, formatSize(v.Size), formatSize(v.Limit), v.Rule)
+}
+
+//budget is one parsed limit
+type budget struct {
+	pattern string //Glob or media type the budget applies to, if any
+	limit   int64
+	fail    bool
+	rule    string
+}
+
+//budgets are the parsed form of Budgets
+type budgets struct {
+	maxFileSize *budget
+	files       []budget
+	types       []budget
+	total       *budget
+}
+
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+}
+
+//ParseSize parses a size such as "300KB", "1.5MB" or "2GB". Units are
+//multiples of 1024 bytes; a plain number is in bytes.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if err != nil || !ok || n < 0 {
+		return 0, fmt.Errorf("%q is not a size such as 300KB, 1.5MB or 2GB", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+//formatSize gives a byte count in human readable units, as ParseSize reads
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 2; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMG"[exp])
+}
+
+//parseBudget parses a limit, optionally preceded by a pattern
+func parseBudget(s string, withPattern bool, example string) (budget, error) {
+	f := strings.Fields(s)
+	b := budget{fail: true, rule: strings.Join(f, " ")}
+	if withPattern {
+		if len(f) < 2 {
+			return b, fmt.Errorf("budget %q should be a pattern then a size, e.g. %q", s, example)
+		}
+		b.pattern, f = f[0], f[1:]
+	}
+	if len(f) == 2 {
+		switch strings.ToLower(f[1]) {
+		case BUDGET_WARN:
+			b.fail = false
+		case BUDGET_FAIL:
+		default:
+			return b, fmt.Errorf("budget %q: %s should be %s or %s", s, f[1], BUDGET_WARN, BUDGET_FAIL)
+		}
+		f = f[:1]
+	}
+	if len(f) != 1 {
+		return b, fmt.Errorf("budget %q should look like %q", s, example)
+	}
+	limit, err := ParseSize(f[0])
+	if err != nil {
+		return b, fmt.Errorf("budget %q: %v", s, err)
+	}
+	b.limit = limit
+	return b, nil
+}
+
+//CheckBudgets reports the first problem with b, as found in the config file
+func CheckBudgets(b Budgets) error {
+	_, err := parseBudgets(b)
+	return err
+}
+
+func parseBudgets(b Budgets) (*budgets, error) {
+	p := &budgets{}
+	if b.MaxFileSize != "" {
+		m, err := parseBudget(b.MaxFileSize, false, "10MB")
+		if err != nil {
+			return nil, err
+		}
+		m.rule = "maxfilesize " + m.rule
+		p.maxFileSize = &m
+	}
+	if b.Total != "" {
+		total, err := parseBudget(b.Total, false, "200MB warn")
+		if err != nil {
+			return nil, err
+		}
+		total.rule = "total " + total.rule
+		p.total = &total
+	}
+	for _, r := range b.Files {
+		f, err := parseBudget(r, true, "video/** 500MB")
+		if err != nil {
+			return nil, err
+		}
+		p.files = append(p.files, f)
+	}
+	for _, r := range b.Types {
+		t, err := parseBudget(r, true, "text/javascript 300KB warn")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := path.Match(t.pattern, ""); err != nil || !strings.Contains(t.pattern, "/") {
+			return nil, fmt.Errorf("budget %q: %s is not a media type such as image/png or image/*", r, t.pattern)
+		}
+		p.types = append(p.types, t)
+	}
+	return p, nil
+}
+
+//mediaType gives the media type of a file from its extension, without any
+//parameters, e.g. text/javascript
+func mediaType(relPath string) string {
+	t := mime.TypeByExtension(path.Ext(filepath.ToSlash(relPath)))
+	if t == "" {
+		return getMediaType(relPath)
+	}
+	if i := strings.Index(t, ";"); i >= 0 {
+		t = t[:i]
+	}
+	return strings.TrimSpace(t)
+}
+
+//fileViolations gives the budgets the file relPath of size bytes exceeds
+func (b *budgets) fileViolations(relPath string, size int64) []BudgetViolation {
+	found := []BudgetViolation{}
+	fileBudget := b.maxFileSize
+	for i := range b.files {
+		if MatchGlob(b.files[i].pattern, relPath) {
+			fileBudget = &b.files[i]
+		}
+	}
+	if fileBudget != nil && size > fileBudget.limit {
+		found = append(found, fileBudget.violation(relPath, size))
+	}
+	if len(b.types) > 0 {
+		t := mediaType(relPath)
+		for _, tb := range b.types {
+			if ok, _ := path.Match(tb.pattern, t); ok && size > tb.limit {
+				found = append(found, tb.violation(relPath, size))
+			}
+		}
+	}
+	return found
+}
+
+func (b budget) violation(relPath string, size int64) BudgetViolation {
+	return BudgetViolation{RelPath: relPath, Rule: b.rule, Size: size, Limit: b.limit, Fail: b.fail}
+}
+
+//checkFileBudget records the budgets srcFile exceeds, returning false if it
+//mustn't be deployed. It is checked before the file is read.
+func (d *DeployScanner) checkFileBudget(srcFile string, sstat os.FileInfo) bool {
+	if d.budgets == nil {
+		return true
+	}
+	ok := true
+	for _, v := range d.budgets.fileViolations(d.getRelativePath(srcFile), sstat.Size()) {
+		d.overBudget(v)
+		ok = ok && !v.Fail
+	}
+	return ok
+}
+
+//checkTotalBudget records a violation if the files to be sent exceed the
+//total budget
+func (d *DeployScanner) checkTotalBudget() {
+	if d.budgets == nil || d.budgets.total == nil || d.sent <= d.budgets.total.limit {
+		return
+	}
+	d.overBudget(d.budgets.total.violation("", d.sent))
+}
+
+func (d *DeployScanner) overBudget(v BudgetViolation) {
+	if v.Fail {
+		jww.ERROR.Println(v)
+	} else {
+		// Warnings are hidden unless verbose, but these matter
+		jww.FEEDBACK.Println(v)
+	}
+	d.violations = append(d.violations, v)
+}
+
+//budgetError gives an error for any budget violations that fail a deployment
+func budgetError(violations []BudgetViolation) error {
+	failed := 0
+	for _, v := range violations {
+		if v.Fail {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	if failed == 1 {
+		for _, v := range violations {
+			if v.Fail {
+				return &Error{Op: OP_BUDGET, Path: v.RelPath, Err: fmt.Errorf("%s is more than %s (%s)", formatSize(v.Size), formatSize(v.Limit), v.Rule)}
+			}
+		}
+	}
+	return &Error{Op: OP_BUDGET, Err: fmt.Errorf("%d size budgets exceeded - nothing was deployed", failed)}
+}
@@ -0,0 +1,174 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/bgentry/go-netrc/netrc"
+	jww "github.com/spf13/jwalterweatherman"
+	"github.com/spf13/viper"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+//KeyringService is the service name passwords are stored under in the OS keyring.
+//Entries are keyed by user@host.
+const KeyringService = "hugodeploy"
+
+//ResolvePassword works out the password for a connection section of the config
+//file (ftp or sftp) when one hasn't been given explicitly (e.g. via --ftppwd).
+//The sources tried, in order, are:
+//  1. HUGODEPLOY_<SECTION>_PWD environment variable
+//  2. <section>.pwd in the config file (plaintext - not recommended)
+//  3. the machine entry for host in ~/.netrc (or $NETRC)
+//  4. the stdout of <section>.pwd_command
+//  5. the OS keyring, if <section>.keyring is true
+//  6. an interactive prompt, if stdin is a terminal
+func ResolvePassword(section, host, user string) (string, error) {
+	pwd, err := resolvePassword(section, host, user)
+	RegisterSecret(pwd)
+	return pwd, err
+}
+
+func resolvePassword(section, host, user string) (string, error) {
+	envVar := "HUGODEPLOY_" + strings.ToUpper(section) + "_PWD"
+	if pwd := os.Getenv(envVar); pwd != "" {
+		jww.INFO.Println("Using password from environment variable ", envVar)
+		return pwd, nil
+	}
+
+	if pwd := viper.GetString(section + ".pwd"); pwd != "" {
+		jww.INFO.Println("Using password from config file: ", section+".pwd")
+		return pwd, nil
+	}
+
+	pwd, err := netrcPassword(host, user)
+	if err != nil {
+		return "", err
+	}
+	if pwd != "" {
+		jww.INFO.Println("Using password from netrc for ", host)
+		return pwd, nil
+	}
+
+	if command := viper.GetString(section + ".pwd_command"); command != "" {
+		jww.INFO.Println("Using password from ", section+".pwd_command")
+		return commandPassword(command)
+	}
+
+	if viper.GetBool(section + ".keyring") {
+		pwd, err := keyring.Get(KeyringService, user+"@"+host)
+		if err == nil {
+			jww.INFO.Println("Using password from OS keyring for ", user+"@"+host)
+			return pwd, nil
+		}
+		jww.WARN.Println("No password found in OS keyring for ", user+"@"+host, ": ", err)
+	}
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return promptPassword(user + "@" + host)
+	}
+
+	return "", fmt.Errorf("no password found for %s@%s. Use --%spwd, %s, %s.pwd_command, ~/.netrc or the OS keyring", user, host, section, envVar, section)
+}
+
+//netrcPassword looks up host in the netrc file. The entry is ignored if its
+//login doesn't match user. A missing netrc file is not an error.
+func netrcPassword(host, user string) (string, error) {
+	m, err := netrcMachine(host)
+	if err != nil || m == nil || (m.Login != "" && m.Login != user) {
+		return "", err
+	}
+	return m.Password, nil
+}
+
+//NetrcLogin gives the login for host in ~/.netrc (or $NETRC), for when the
+//config file doesn't name a user. It is empty if there is no entry for host.
+func NetrcLogin(host string) (string, error) {
+	m, err := netrcMachine(host)
+	if err != nil || m == nil {
+		return "", err
+	}
+	return m.Login, nil
+}
+
+//netrcMachine finds the entry for host in the netrc file, or the default
+//entry. A missing netrc file is not an error.
+func netrcMachine(host string) (*netrc.Machine, error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		name := ".netrc"
+		if runtime.GOOS == "windows" {
+			name = "_netrc"
+		}
+		path = filepath.Join(home, name)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	m, err := netrc.FindMachine(path, host)
+	if err != nil {
+		return nil, fmt.Errorf("error reading netrc file %s: %v", path, err)
+	}
+	return m, nil
+}
+
+//commandPassword runs command through the shell and uses its stdout, less the
+//trailing newline, as the password. This allows passwords to be fetched from
+//password managers, e.g. pwd_command: pass show web/ftp
+func commandPassword(command string) (string, error) {
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.Command("cmd", "/C", command)
+	} else {
+		c = exec.Command("sh", "-c", command)
+	}
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = os.Stderr
+	c.Stdin = os.Stdin
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("pwd_command failed: %v", err)
+	}
+	pwd := strings.TrimRight(stdout.String(), "\r\n")
+	if pwd == "" {
+		return "", errors.New("pwd_command returned an empty password")
+	}
+	return pwd, nil
+}
+
+//promptPassword asks for the password on the terminal without echoing it.
+func promptPassword(account string) (string, error) {
+	fmt.Fprint(os.Stderr, "Password for ", account, ": ")
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("error reading password: %v", err)
+	}
+	return string(b), nil
+}
@@ -14,7 +14,13 @@
 
 package deploy
 
-//TODO: Provide Deployer map to allow more flexible configuration
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
 
 //Deployer interface
 type Deployer interface {
@@ -24,6 +30,38 @@ type Deployer interface {
 	ApplyCommand(cmd *DeployCommand) error
 }
 
+//Prober is implemented by Deployers that can help diagnose connection problems.
+//Both methods may only be called after a successful Initialise.
+type Prober interface {
+	Ping() error      //Round trip to the server that changes nothing
+	CheckRoot() error //Confirms the website root directory exists
+}
+
+//deployers maps the names that can be used for the deployer config option to
+//constructors for the deployment targets
+var deployers = map[string]func() Deployer{
+	"ftp":  func() Deployer { return &FTPDeployer{} },
+	"sftp": func() Deployer { return &SFTPDeployer{} },
+}
+
+//NewDeployer returns an uninitialised Deployer for the named deployment target
+func NewDeployer(name string) (Deployer, error) {
+	if d, ok := deployers[strings.ToLower(name)]; ok {
+		return d(), nil
+	}
+	return nil, fmt.Errorf("unknown deployer %q. Valid deployers are: %s", name, strings.Join(DeployerNames(), ", "))
+}
+
+//DeployerNames lists the valid deployment target names
+func DeployerNames() []string {
+	names := make([]string, 0, len(deployers))
+	for n := range deployers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type CommandType int
 type commandHandler func(cmd *DeployCommand) (err error)
 
@@ -33,6 +71,7 @@ const (
 	COMMAND_FILE_UPD
 	COMMAND_FILE_DEL
 	COMMAND_DIR_DEL
+	COMMAND_LINK_ADD //Create or replace a symbolic link, when links are preserved
 )
 
 func (cmd *DeployCommand) GetCommandDesc() string {
@@ -49,6 +88,8 @@ func (cmd *DeployCommand) GetCommandDesc() string {
 		s = "DELETE FILE"
 	case COMMAND_FILE_UPD:
 		s = "UPDATE FILE"
+	case COMMAND_LINK_ADD:
+		s = "ADD LINK"
 	default:
 		s = ""
 	}
@@ -56,7 +97,18 @@ func (cmd *DeployCommand) GetCommandDesc() string {
 }
 
 type DeployCommand struct {
-	RelPath  string
-	Contents []byte
-	Command  CommandType
+	RelPath    string
+	Contents   []byte
+	Command    CommandType
+	Size       int64       //Bytes to be sent for file commands, after minification
+	SourceSize int64       //Size of the source file before minification
+	Mode       os.FileMode //Permissions to set on the target. 0 leaves the target's default
+	ModTime    time.Time   //Modification time to set on the target file. Zero leaves it alone
+	LinkTarget string      //What a COMMAND_LINK_ADD link points to, exactly as in the source
+	srcPath    string      //Source file, so Contents can be reloaded when applying a Plan
+}
+
+//IsFileCommand is true for commands that transfer file contents
+func (cmd *DeployCommand) IsFileCommand() bool {
+	return cmd.Command == COMMAND_FILE_ADD || cmd.Command == COMMAND_FILE_UPD
 }
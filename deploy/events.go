@@ -0,0 +1,205 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+//EventType identifies what an Event reports
+type EventType int
+
+const (
+	EVENT_SCAN_START EventType = iota
+	EVENT_SCAN_FINISH
+	EVENT_FILE_COMPARED
+	EVENT_COMMAND_START
+	EVENT_COMMAND_SUCCESS
+	EVENT_COMMAND_FAILURE
+	EVENT_BYTES_TRANSFERRED
+	EVENT_SUMMARY
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EVENT_SCAN_START:
+		return "scan_start"
+	case EVENT_SCAN_FINISH:
+		return "scan_finish"
+	case EVENT_FILE_COMPARED:
+		return "file_compared"
+	case EVENT_COMMAND_START:
+		return "command_start"
+	case EVENT_COMMAND_SUCCESS:
+		return "command_success"
+	case EVENT_COMMAND_FAILURE:
+		return "command_failure"
+	case EVENT_BYTES_TRANSFERRED:
+		return "bytes_transferred"
+	case EVENT_SUMMARY:
+		return "summary"
+	}
+	return "unknown"
+}
+
+//CompareResult is the outcome of comparing a source file or directory with
+//the deploy record
+type CompareResult int
+
+const (
+	COMPARE_SAME CompareResult = iota
+	COMPARE_NEW
+	COMPARE_CHANGED
+	COMPARE_TYPE_CHANGED //File replaced by directory or vice versa
+	COMPARE_DELETED
+	COMPARE_SKIPPED
+)
+
+func (r CompareResult) String() string {
+	switch r {
+	case COMPARE_SAME:
+		return "same"
+	case COMPARE_NEW:
+		return "new"
+	case COMPARE_CHANGED:
+		return "changed"
+	case COMPARE_TYPE_CHANGED:
+		return "type_changed"
+	case COMPARE_DELETED:
+		return "deleted"
+	case COMPARE_SKIPPED:
+		return "skipped"
+	}
+	return "unknown"
+}
+
+//Event is passed to Observers as a deployment progresses. Only the fields
+//relevant to Type are set.
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	RelPath string         //File or directory concerned
+	Command *DeployCommand //Command events. Don't hold on to Contents
+	Compare CompareResult  //EVENT_FILE_COMPARED
+	Bytes   int64          //EVENT_BYTES_TRANSFERRED
+	Plan    *Plan          //EVENT_SCAN_FINISH
+	Summary *Summary       //EVENT_SUMMARY
+	Err     error          //EVENT_COMMAND_FAILURE, and EVENT_SUMMARY if the deployment failed
+}
+
+//Observer receives deployment events. Notify is called synchronously from the
+//deployment so it should return quickly.
+type Observer interface {
+	Notify(ev *Event)
+}
+
+//ObserverFunc allows an ordinary function to be used as an Observer
+type ObserverFunc func(ev *Event)
+
+func (f ObserverFunc) Notify(ev *Event) {
+	f(ev)
+}
+
+//Summary totals up what a deployment did
+type Summary struct {
+	Commands         map[CommandType]int //Successful commands by type
+	Failed           int
+	BytesTransferred int64
+	BytesSaved       int64 //By minifying the files transferred
+	Retries          int   //Uploads sent again after failing verification
+	Start            time.Time
+	Elapsed          time.Duration
+}
+
+func newSummary() *Summary {
+	return &Summary{Commands: make(map[CommandType]int), Start: time.Now()}
+}
+
+//observers fans events out to a list of Observers
+type observers []Observer
+
+func (o observers) notify(ev *Event) {
+	if len(o) == 0 {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	for _, obs := range o {
+		obs.Notify(ev)
+	}
+}
+
+type jsonEvent struct {
+	Type     string         `json:"type"`
+	Time     time.Time      `json:"time"`
+	Path     string         `json:"path,omitempty"`
+	Command  string         `json:"command,omitempty"`
+	Size     int64          `json:"size,omitempty"`
+	Compare  string         `json:"compare,omitempty"`
+	Bytes    int64          `json:"bytes,omitempty"`
+	Planned  int            `json:"planned,omitempty"`
+	Error    string         `json:"error,omitempty"`
+	Commands map[string]int `json:"commands,omitempty"`
+	Failed   int            `json:"failed,omitempty"`
+	Elapsed  float64        `json:"elapsed_seconds,omitempty"`
+	Saved    int64          `json:"bytes_saved,omitempty"`
+	Retries  int            `json:"retries,omitempty"`
+}
+
+type jsonObserver struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+//NewJSONObserver returns an Observer that writes each event to w as a line of
+//JSON. Secrets are redacted from error messages.
+func NewJSONObserver(w io.Writer) Observer {
+	return &jsonObserver{enc: json.NewEncoder(w)}
+}
+
+func (j *jsonObserver) Notify(ev *Event) {
+	je := jsonEvent{Type: ev.Type.String(), Time: ev.Time, Path: ev.RelPath, Bytes: ev.Bytes}
+	if ev.Command != nil {
+		je.Command = ev.Command.GetCommandDesc()
+		je.Size = ev.Command.Size
+	}
+	if ev.Type == EVENT_FILE_COMPARED {
+		je.Compare = ev.Compare.String()
+	}
+	if ev.Plan != nil {
+		je.Planned = len(ev.Plan.Commands)
+	}
+	if ev.Err != nil {
+		je.Error = Redact(ev.Err.Error())
+	}
+	if s := ev.Summary; s != nil {
+		je.Commands = make(map[string]int)
+		for c, n := range s.Commands {
+			je.Commands[(&DeployCommand{Command: c}).GetCommandDesc()] = n
+		}
+		je.Failed = s.Failed
+		je.Bytes = s.BytesTransferred
+		je.Saved = s.BytesSaved
+		je.Retries = s.Retries
+		je.Elapsed = s.Elapsed.Seconds()
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(je)
+}
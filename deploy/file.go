@@ -16,15 +16,17 @@ package deploy
 
 import (
 	"errors"
+	"github.com/spf13/afero"
 	jww "github.com/spf13/jwalterweatherman"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type FileDeployer struct {
 	TargetDir string
+	Fs        afero.Fs //Filesystem holding TargetDir. Defaults to the operating system's
 }
 
 func (f *FileDeployer) GetName() string {
@@ -33,9 +35,9 @@ func (f *FileDeployer) GetName() string {
 
 func (f *FileDeployer) Initialise() error {
 	if f.TargetDir == "" {
-		panic(errors.New("TargetDir not set for FileDeployer - aborting before anything bad happens"))
-		os.Exit(-1)
+		return errors.New("TargetDir not set for FileDeployer - aborting before anything bad happens")
 	}
+	f.Fs = osFsIfNil(f.Fs)
 	return nil
 }
 
@@ -43,10 +45,16 @@ func (f *FileDeployer) ApplyCommand(cmd *DeployCommand) error {
 	path := filepath.Join(f.TargetDir, cmd.RelPath)
 	switch cmd.Command {
 	case COMMAND_FILE_ADD, COMMAND_FILE_UPD:
-		return f.UploadFile(path, cmd.Contents)
+		if err := f.UploadFile(path, cmd.Contents); err != nil {
+			return err
+		}
+		return f.SetAttributes(path, cmd.Mode, cmd.ModTime)
 
 	case COMMAND_DIR_ADD:
-		return f.MakeDirectory(path)
+		if err := f.MakeDirectory(path); err != nil {
+			return err
+		}
+		return f.SetAttributes(path, cmd.Mode, time.Time{})
 
 	case COMMAND_DIR_DEL:
 		return f.RemoveDirectory(path)
@@ -54,15 +62,16 @@ func (f *FileDeployer) ApplyCommand(cmd *DeployCommand) error {
 	case COMMAND_FILE_DEL:
 		return f.RemoveFile(path)
 
+	case COMMAND_LINK_ADD:
+		return f.MakeLink(path, cmd.LinkTarget)
+
 	default:
 		return errors.New("Not implemented")
 	}
-	//jww.WARN.Println("SFTP Cmds not implemented yet: ", cmd.RelPath)
-	return nil
 }
 
 func (f *FileDeployer) UploadFile(path string, data []byte) error {
-	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+	if err := afero.WriteFile(f.Fs, path, data, 0644); err != nil {
 		jww.ERROR.Println("Error writing file: ", path, err)
 		return err
 	} else {
@@ -73,7 +82,7 @@ func (f *FileDeployer) UploadFile(path string, data []byte) error {
 
 func (f *FileDeployer) RemoveDirectory(path string) error {
 	jww.WARN.Println("Removing directory: ", path)
-	if err := os.RemoveAll(path); err != nil {
+	if err := f.Fs.RemoveAll(path); err != nil {
 		jww.ERROR.Println("Error deleting dir: ", path, err)
 		return err
 	} else {
@@ -84,7 +93,7 @@ func (f *FileDeployer) RemoveDirectory(path string) error {
 
 func (f *FileDeployer) RemoveFile(path string) error {
 	jww.WARN.Println("Removing file: ", path)
-	if err := os.Remove(path); err != nil {
+	if err := f.Fs.Remove(path); err != nil {
 		jww.ERROR.Println("Error deleting file: ", path, err)
 		return err
 	} else {
@@ -94,9 +103,9 @@ func (f *FileDeployer) RemoveFile(path string) error {
 }
 
 func (f *FileDeployer) MakeDirectory(path string) error {
-	if err := os.Mkdir(path, 0777); err != nil {
+	if err := f.Fs.Mkdir(path, 0777); err != nil {
 		jww.ERROR.Println("Error creating directory: ", path, err)
-		if strings.Contains(err.Error(), "File exists") {
+		if os.IsExist(err) || strings.Contains(err.Error(), "File exists") {
 			jww.INFO.Println("Looks like directory already exists: ", path)
 			return nil
 		} else {
@@ -108,6 +117,80 @@ func (f *FileDeployer) MakeDirectory(path string) error {
 	return nil
 }
 
+//MakeLink creates a symbolic link at path pointing to target, replacing
+//whatever file or link is already there
+func (f *FileDeployer) MakeLink(path string, target string) error {
+	linker, ok := f.Fs.(afero.Linker)
+	if !ok {
+		return errors.New("filesystem doesn't support symbolic links")
+	}
+	if err := f.Fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		jww.ERROR.Println("Error replacing with link: ", path, err)
+		return err
+	}
+	if err := linker.SymlinkIfPossible(target, path); err != nil {
+		jww.ERROR.Println("Error creating link: ", path, err)
+		return err
+	}
+	jww.INFO.Println("Successfully created link: ", path, " -> ", target)
+	return nil
+}
+
+//SetAttributes sets the permissions and modification time of path where they
+//are given
+func (f *FileDeployer) SetAttributes(path string, mode os.FileMode, mtime time.Time) error {
+	if mode != 0 {
+		if err := f.Fs.Chmod(path, mode); err != nil {
+			jww.ERROR.Println("Error setting permissions: ", path, err)
+			return err
+		}
+	}
+	if !mtime.IsZero() {
+		if err := f.Fs.Chtimes(path, mtime, mtime); err != nil {
+			jww.ERROR.Println("Error setting modification time: ", path, err)
+			return err
+		}
+	}
+	return nil
+}
+
+//List describes the contents of relDir in TargetDir
+func (f *FileDeployer) List(relDir string) ([]RemoteFile, error) {
+	infos, err := afero.ReadDir(osFsIfNil(f.Fs), filepath.Join(f.TargetDir, relDir))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]RemoteFile, 0, len(infos))
+	for _, fi := range infos {
+		files = append(files, RemoteFile{Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()})
+	}
+	return files, nil
+}
+
+//Size gives the size of relPath in TargetDir
+func (f *FileDeployer) Size(relPath string) (int64, error) {
+	fi, err := osFsIfNil(f.Fs).Stat(filepath.Join(f.TargetDir, relPath))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+//Download reads relPath from TargetDir
+func (f *FileDeployer) Download(relPath string) ([]byte, error) {
+	return afero.ReadFile(osFsIfNil(f.Fs), filepath.Join(f.TargetDir, relPath))
+}
+
+//Checksum gives the SHA-256 checksum of relPath in TargetDir
+func (f *FileDeployer) Checksum(relPath string) (string, string, error) {
+	data, err := afero.ReadFile(osFsIfNil(f.Fs), filepath.Join(f.TargetDir, relPath))
+	if err != nil {
+		return "", "", err
+	}
+	sum, err := HashData(HASH_SHA256, data)
+	return HASH_SHA256, sum, err
+}
+
 func (f *FileDeployer) Cleanup() error {
 	//Nothing to do
 	return nil
@@ -18,23 +18,32 @@ import (
 	"bytes"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"path"
 	"strings"
 	"os"
+	"time"
 
 	"github.com/dutchcoders/goftp"
 	jww "github.com/spf13/jwalterweatherman"
 	"github.com/spf13/viper"
 )
 
+//FTP_DEFAULT_PORT is used when no port is configured
+const FTP_DEFAULT_PORT = "21"
+
 type FTPDeployer struct {
-	HostID     string
-	Port       string
-	UID        string
-	PWD        string
-	RootDir    string
-	DisableTLS bool
-	ftp        *goftp.FTP
+	HostID      string
+	Port        string
+	UID         string
+	PWD         string
+	RootDir     string
+	DisableTLS  bool
+	ftp         *goftp.FTP
+	checksumCmd int  //Index into ftpChecksumCmds of the first one worth trying
+	noChmod     bool //Server doesn't support SITE CHMOD
+	noMFMT      bool //Server doesn't support MFMT
 }
 
 func (f *FTPDeployer) GetName() string {
@@ -44,13 +53,16 @@ func (f *FTPDeployer) GetName() string {
 func (f *FTPDeployer) Initialise() error {
 	serr := ""
 	jww.INFO.Println("Getting FTP settings")
-	// Gather together settings
-	f.HostID = viper.GetString("ftp.host")
-	f.Port = viper.GetString("ftp.port")
-	f.UID = viper.GetString("ftp.user")
-	f.PWD = viper.GetString("ftp.pwd")
-	f.RootDir = viper.GetString("ftp.rootdir")
-	f.DisableTLS = false
+	// Gather together settings. Anything already set (e.g. when hugodeploy is
+	// used as a library) takes precedence over the config file
+	setFromConfig(&f.HostID, "ftp.host")
+	setFromConfig(&f.Port, "ftp.port")
+	setFromConfig(&f.UID, "ftp.user")
+	setFromConfig(&f.RootDir, "ftp.rootdir")
+	setUserFromNetrc(&f.UID, f.HostID)
+	if f.Port == "" {
+		f.Port = FTP_DEFAULT_PORT
+	}
 	if viper.IsSet("ftp.disabletls") {
 		f.DisableTLS = viper.GetBool("ftp.disabletls")
 	}
@@ -60,23 +72,24 @@ func (f *FTPDeployer) Initialise() error {
 	if f.HostID == "" {
 		serr = serr + "HostID not found. Define ftp.host in config file. "
 	}
-	if f.Port == "" {
-		serr = serr + "Port not found. Define ftp.port in config file. "
-	}
 	if f.UID == "" {
-		serr = serr + "UID not found. Define ftp.user in config file. "
-	}
-	if f.PWD == "" {
-		serr = serr + "PWD not found. Define ftp.pwd in config file. "
+		serr = serr + "UID not found. Define ftp.user in config file or a login in ~/.netrc. "
 	}
 	if f.RootDir == "" {
 		f.RootDir = "/"
 		jww.WARN.Println("FTP: Website root directory not found (ftp: rootdir in config). Defaulting to '/'")
 	}
+	RegisterSecret(f.PWD)
+	if serr == "" && f.PWD == "" {
+		var perr error
+		if f.PWD, perr = ResolvePassword("ftp", f.HostID, f.UID); perr != nil {
+			serr = serr + perr.Error() + ". "
+		}
+	}
 
 	if serr != "" {
 		jww.ERROR.Println("Error initialising FTP Deployer: ", serr)
-		panic(errors.New("Error initialising FTP Deployer. " + serr))
+		return errors.New("Error initialising FTP Deployer. " + serr)
 	}
 
 	var err error
@@ -86,13 +99,13 @@ func (f *FTPDeployer) Initialise() error {
 	if !viper.GetBool("debug") && !viper.GetBool("verbose") {
 		if f.ftp, err = goftp.Connect(f.HostID + ":" + f.Port); err != nil {
 			jww.ERROR.Println("Failed initial FTP connection: ", err)
-			return err
+			return fmt.Errorf("FTP connect failed: %v", err)
 		}
 	} else {
 		jww.INFO.Println("Connecting to ftp in debug mode")
 		if f.ftp, err = goftp.ConnectDbg(f.HostID + ":" + f.Port); err != nil {
 			jww.ERROR.Println("Failed initial FTP connection: ", err)
-			return err
+			return fmt.Errorf("FTP connect failed: %v", err)
 		}
 	}
 
@@ -105,7 +118,7 @@ func (f *FTPDeployer) Initialise() error {
 
 		if err = f.ftp.AuthTLS(&config); err != nil {
 			jww.ERROR.Println("Failed TLS Activation: ", err)
-			return err
+			return fmt.Errorf("FTP TLS activation failed: %v", err)
 		}
 	} else {
 		jww.WARN.Println("FTP TLS disabled - data will be transmitted in clear text")
@@ -113,7 +126,7 @@ func (f *FTPDeployer) Initialise() error {
 
 	if err = f.ftp.Login(f.UID, f.PWD); err != nil {
 		jww.ERROR.Println("Failed FTP Login: ", err)
-		return err
+		return fmt.Errorf("FTP login failed: %v", err)
 	}
 
 	jww.FEEDBACK.Println("Successfully connected to FTP")
@@ -122,6 +135,25 @@ func (f *FTPDeployer) Initialise() error {
 
 }
 
+//setFromConfig sets *field from the config setting key, unless it is already set
+func setFromConfig(field *string, key string) {
+	if *field == "" {
+		*field = viper.GetString(key)
+	}
+}
+
+//setUserFromNetrc fills in an unset user with the login in the netrc entry
+//for host, if there is one
+func setUserFromNetrc(user *string, host string) {
+	if *user != "" || host == "" {
+		return
+	}
+	if login, err := NetrcLogin(host); err == nil && login != "" {
+		jww.INFO.Println("Using login from netrc for ", host)
+		*user = login
+	}
+}
+
 func makeFtpPath(path string) string {
 	fpath := path
 
@@ -143,10 +175,16 @@ func (f *FTPDeployer) ApplyCommand(cmd *DeployCommand) error {
 	
 	switch cmd.Command {
 	case COMMAND_FILE_ADD, COMMAND_FILE_UPD:
-		return f.UploadFile(p, cmd.Contents)
+		if err := f.UploadFile(p, cmd.Contents); err != nil {
+			return err
+		}
+		return f.SetAttributes(p, cmd.Mode, cmd.ModTime)
 
 	case COMMAND_DIR_ADD:
-		return f.MakeDirectory(p)
+		if err := f.MakeDirectory(p); err != nil {
+			return err
+		}
+		return f.SetAttributes(p, cmd.Mode, time.Time{})
 
 	case COMMAND_DIR_DEL:
 		return f.RemoveDirectory(p)
@@ -154,6 +192,9 @@ func (f *FTPDeployer) ApplyCommand(cmd *DeployCommand) error {
 	case COMMAND_FILE_DEL:
 		return f.RemoveFile(p)
 
+	case COMMAND_LINK_ADD:
+		return errors.New("FTP can't create symbolic links - set symlinks to follow or skip")
+
 	default:
 		return errors.New("Not implemented")
 	}
@@ -167,7 +208,6 @@ func (f *FTPDeployer) UploadFile(path string, data []byte) error {
 	
 	if err := f.ftp.Stor(path, r); err != nil {
 		jww.ERROR.Println("FTP Error uploading file: ", path, err)
-		jww.DEBUG.Println("Data that could not be sent: ", data)
 		return err
 	} else {
 		jww.INFO.Println("Successfully FTP'd file: ", path)
@@ -176,15 +216,19 @@ func (f *FTPDeployer) UploadFile(path string, data []byte) error {
 }
 
 func (f *FTPDeployer) RemoveDirectory(path string) error {
-	jww.WARN.Println("FTP Directory delete requested, but not implemented")
-	/*
-		if err := f.ftp.Rmd(path); err != nil {
-			jww.ERROR.Println("FTP Error deleting directory: ", path, err)
-			return err
-		} else {
-			jww.INFO.Println("Successfully deleted directory: ", path)
+	jww.FEEDBACK.Println("Deleting directory: ", path, "...")
+
+	//The scanner deletes a directory's contents first, as FTP servers
+	//only remove empty directories
+	if err := f.ftp.Rmd(path); err != nil {
+		if ftpReplyMatches(err, ftpNotFoundPhrases) || f.pathMissing(path) {
+			jww.INFO.Println("Looks like FTP directory already deleted: ", path)
+			return nil
 		}
-	*/
+		jww.ERROR.Println("FTP Error deleting directory: ", path, err)
+		return err
+	}
+	jww.INFO.Println("Successfully deleted directory: ", path)
 	return nil
 }
 
@@ -192,7 +236,7 @@ func (f *FTPDeployer) RemoveFile(path string) error {
 	jww.FEEDBACK.Println("Deleting file: ", path, "...")
 
 	if err := f.ftp.Dele(path); err != nil {
-		if strings.Contains(err.Error(), "No such file") {
+		if ftpReplyMatches(err, ftpNotFoundPhrases) || f.pathMissing(path) {
 			jww.INFO.Println("Looks like FTP file already deleted: ", path)
 			return nil
 		} else {
@@ -208,7 +252,7 @@ func (f *FTPDeployer) RemoveFile(path string) error {
 func (f *FTPDeployer) MakeDirectory(path string) error {	
 	jww.FEEDBACK.Println("Creating directory: ", path, "...")
 	if err := f.ftp.Mkd(path); err != nil {
-		if strings.Contains(err.Error(), "File exists") {
+		if ftpReplyMatches(err, ftpExistsPhrases) || f.directoryExists(path) {
 			jww.INFO.Println("Looks like FTP directory already exists: ", path)
 			return nil
 		} else {
@@ -221,9 +265,199 @@ func (f *FTPDeployer) MakeDirectory(path string) error {
 	return nil
 }
 
-func (f *FTPDeployer) Cleanup() error {
+//Servers word their error replies differently, so these are the phrases that
+//mean a file or directory is already there, or isn't there
+var ftpExistsPhrases = []string{"file exists", "already exists", "directory exists"}
+var ftpNotFoundPhrases = []string{"no such file", "not found", "does not exist", "doesn't exist", "cannot find", "can't find"}
+
+//ftpReplyMatches checks whether an error reply from the server contains any of phrases
+func ftpReplyMatches(err error, phrases []string) bool {
+	msg := strings.ToLower(err.Error())
+	for _, p := range phrases {
+		if strings.Contains(msg, p) {
+			return true
+		}
+	}
+	return false
+}
 
-	f.ftp.Close()
+//directoryExists checks for a directory by changing into it, for servers
+//whose replies to MKD don't say why it failed. The working directory is
+//restored afterwards as RootDir may be relative to it.
+func (f *FTPDeployer) directoryExists(path string) bool {
+	wd, err := f.ftp.Pwd()
+	if err != nil {
+		return false
+	}
+	if err := f.ftp.Cwd(path); err != nil {
+		return false
+	}
+	if err := f.ftp.Cwd(wd); err != nil {
+		jww.WARN.Println("FTP couldn't return to directory ", wd, ": ", err)
+	}
+	return true
+}
 
+//pathMissing checks p has gone by listing the directory holding it, for
+//servers whose replies to DELE and RMD don't say why they failed
+func (f *FTPDeployer) pathMissing(p string) bool {
+	lines, err := f.ftp.List(path.Dir(p))
+	if err != nil {
+		return false
+	}
+	name := path.Base(p)
+	for _, l := range lines {
+		// LIST, MLSD and NLST all end each line with the name
+		l = strings.TrimRight(l, "\r\n")
+		if l == name || strings.HasSuffix(l, " "+name) {
+			return false
+		}
+	}
+	return true
+}
+
+//List describes the contents of relDir on the server
+func (f *FTPDeployer) List(relDir string) ([]RemoteFile, error) {
+	p := makeFtpPath(path.Join(f.RootDir, relDir))
+	lines, err := f.ftp.List(p)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	files := []RemoteFile{}
+	for _, l := range lines {
+		if rf, ok := parseListLine(strings.TrimRight(l, "\r\n"), now); ok {
+			files = append(files, rf)
+		}
+	}
+	return files, nil
+}
+
+//Size gives the size of relPath on the server
+func (f *FTPDeployer) Size(relPath string) (int64, error) {
+	n, err := f.ftp.Size(makeFtpPath(path.Join(f.RootDir, relPath)))
+	return int64(n), err
+}
+
+//Download fetches relPath from the server
+func (f *FTPDeployer) Download(relPath string) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := f.ftp.Retr(makeFtpPath(path.Join(f.RootDir, relPath)), func(r io.Reader) error {
+		_, err := buf.ReadFrom(r)
+		return err
+	})
+	return buf.Bytes(), err
+}
+
+//ftpChecksumCmds are the checksum commands tried in order of preference. HASH
+//is the draft standard; the X commands are older extensions.
+var ftpChecksumCmds = []struct{ cmd, algorithm string }{
+	{"HASH", ""},
+	{"XSHA256", HASH_SHA256},
+	{"XSHA1", HASH_SHA1},
+	{"XMD5", HASH_MD5},
+	{"XCRC", HASH_CRC32},
+}
+
+//Checksum asks the server for a checksum of relPath. The first command the
+//server accepts is remembered for later calls.
+func (f *FTPDeployer) Checksum(relPath string) (string, string, error) {
+	p := makeFtpPath(path.Join(f.RootDir, relPath))
+	for i := f.checksumCmd; i < len(ftpChecksumCmds); i++ {
+		c := ftpChecksumCmds[i]
+		code, reply := f.ftp.RawCmd("%s %s", c.cmd, p)
+		jww.DEBUG.Println("FTP checksum ", c.cmd, ": ", code, reply)
+		switch {
+		case ftpNotSupported(code):
+			// Try the next one
+			f.checksumCmd = i + 1
+			continue
+		case code < 200 || code > 299:
+			return "", "", fmt.Errorf("%s %s failed: %s", c.cmd, p, strings.TrimSpace(reply))
+		}
+		algorithm, sum, err := parseChecksumReply(c.cmd, c.algorithm, reply)
+		if err != nil {
+			return "", "", err
+		}
+		return algorithm, sum, nil
+	}
+	return "", "", ErrChecksumUnsupported
+}
+
+//parseChecksumReply extracts the checksum from a reply such as
+//  213 SHA-256 0-1234 9f86d08...15b0f00a08 index.html   (HASH)
+//  250 9F86D08...15B0F00A08                             (X commands)
+func parseChecksumReply(cmd, algorithm, reply string) (string, string, error) {
+	f := strings.Fields(reply)
+	if len(f) > 0 && len(f[0]) == 3 {
+		f = f[1:] // Reply code
+	}
+	if cmd == "HASH" {
+		if len(f) < 3 {
+			return "", "", fmt.Errorf("can't understand HASH reply: %s", reply)
+		}
+		algorithm = strings.ToLower(strings.Replace(f[0], "-", "", -1))
+		f = f[2:]
+	}
+	if len(f) == 0 {
+		return "", "", fmt.Errorf("can't understand %s reply: %s", cmd, reply)
+	}
+	sum := strings.ToLower(f[0])
+	if algorithm == HASH_CRC32 && len(sum) < 8 {
+		// Some servers don't pad CRCs with leading zeroes
+		sum = strings.Repeat("0", 8-len(sum)) + sum
+	}
+	return algorithm, sum, nil
+}
+
+//ftpNotSupported checks whether a reply code means the server doesn't
+//understand or implement a command
+func ftpNotSupported(code int) bool {
+	return code == 500 || code == 501 || code == 502 || code == 504
+}
+
+//SetAttributes sets the permissions (SITE CHMOD) and modification time (MFMT)
+//of path where they are given. If the server doesn't support one of the
+//commands a warning is given the first time and the push carries on.
+func (f *FTPDeployer) SetAttributes(path string, mode os.FileMode, mtime time.Time) error {
+	if mode != 0 && !f.noChmod {
+		code, reply := f.ftp.RawCmd("SITE CHMOD %o %s", mode, path)
+		switch {
+		case ftpNotSupported(code):
+			f.noChmod = true
+			jww.WARN.Println("FTP server doesn't support SITE CHMOD - file permissions won't be set")
+		case code < 200 || code > 299:
+			return fmt.Errorf("SITE CHMOD %o %s failed: %s", mode, path, strings.TrimSpace(reply))
+		default:
+			jww.INFO.Println("Set permissions of ", path, " to ", fmt.Sprintf("%04o", mode))
+		}
+	}
+	if !mtime.IsZero() && !f.noMFMT {
+		code, reply := f.ftp.RawCmd("MFMT %s %s", mtime.UTC().Format("20060102150405"), path)
+		switch {
+		case ftpNotSupported(code):
+			f.noMFMT = true
+			jww.WARN.Println("FTP server doesn't support MFMT - file modification times won't be set")
+		case code < 200 || code > 299:
+			return fmt.Errorf("MFMT %s failed: %s", path, strings.TrimSpace(reply))
+		}
+	}
 	return nil
 }
+
+//Ping does a round trip to the server without changing anything
+func (f *FTPDeployer) Ping() error {
+	return f.ftp.Noop()
+}
+
+//CheckRoot confirms the website root directory exists on the server
+func (f *FTPDeployer) CheckRoot() error {
+	return f.ftp.Cwd(makeFtpPath(f.RootDir))
+}
+
+func (f *FTPDeployer) Cleanup() error {
+	if f.ftp == nil {
+		return nil
+	}
+	return f.ftp.Close()
+}
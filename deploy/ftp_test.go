@@ -0,0 +1,140 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/mindok/hugodeploy/deploy"
+	"github.com/mindok/hugodeploy/deploy/ftptest"
+	"github.com/spf13/afero"
+)
+
+//ftpServers are the server behaviours each FTP test is run against: the
+//presets, then each quirk on its own. The single quirks come with replies
+//that don't say why MKD or DELE failed, so FTPDeployer falls back to
+//checking with CWD and a listing, through that quirk.
+var ftpServers = []struct {
+	name   string
+	quirks ftptest.Quirks
+}{
+	{"default", ftptest.Quirks{}},
+	{"vsftpd", ftptest.QUIRKS_VSFTPD},
+	{"pure-ftpd", ftptest.QUIRKS_PUREFTPD},
+	{"filezilla", ftptest.QUIRKS_FILEZILLA},
+	{"no MLSD", vagueReplies(ftptest.Quirks{NoMLSD: true})},
+	{"passive only", vagueReplies(ftptest.Quirks{PassiveOnly: true})},
+	{"TLS required", vagueReplies(ftptest.Quirks{RequireTLS: true})},
+	{"no TLS", vagueReplies(ftptest.Quirks{NoTLS: true})},
+}
+
+//vagueReplies gives q the same reply to every failed MKD and DELE
+func vagueReplies(q ftptest.Quirks) ftptest.Quirks {
+	q.MkdExistsReply = "550 Operation failed."
+	q.DeleMissingReply = "550 Operation failed."
+	return q
+}
+
+//TestFTPDeploy pushes a site to a test FTP server, then pushes it again after
+//adding, updating and deleting files and swapping a file and a directory,
+//checking what ends up on the server each time
+func TestFTPDeploy(t *testing.T) {
+	for _, s := range ftpServers {
+		t.Run(s.name, func(t *testing.T) {
+			srv, err := ftptest.NewServer(s.quirks)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			// A directory already on the server gets the server's "exists" reply
+			if err := srv.Fs.MkdirAll("/www/css", 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			src := afero.NewMemMapFs()
+			record := afero.NewMemMapFs()
+			if err := record.MkdirAll("/record", 0755); err != nil {
+				t.Fatal(err)
+			}
+			opts := deploy.Options{
+				SourceDir: "/public",
+				RecordDir: "/record",
+				SourceFs:  src,
+				RecordFs:  record,
+				Deployer:  srv.Deployer("/www"),
+			}
+
+			// Add
+			site := map[string]string{
+				"index.html":     "<p>Home</p>",
+				"css/site.css":   "body{}",
+				"old/page.html":  "<p>Old</p>",
+				"old/deep/a.png": "png",
+				"was-file":       "file",
+				"was-dir/x.html": "<p>x</p>",
+			}
+			deploy.WriteTree(t, src, "/public", site)
+			if err := deploy.Run(context.Background(), opts); err != nil {
+				t.Fatal("adding: ", err)
+			}
+			deploy.CheckTree(t, srv.Fs, "/www", site)
+
+			// Update, delete and swap a file and a directory. A file already
+			// removed from the server gets its "missing" reply
+			if err := srv.Fs.Remove("/www/old/page.html"); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{"old", "was-file", "was-dir"} {
+				if err := src.RemoveAll(path.Join("/public", p)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			deploy.WriteTree(t, src, "/public", map[string]string{
+				"index.html":      "<p>New home</p>",
+				"was-file/y.html": "<p>y</p>",
+				"was-dir":         "file",
+			})
+			if err := deploy.Run(context.Background(), opts); err != nil {
+				t.Fatal("updating: ", err)
+			}
+			deploy.CheckTree(t, srv.Fs, "/www", map[string]string{
+				"index.html":      "<p>New home</p>",
+				"css/site.css":    "body{}",
+				"was-file/y.html": "<p>y</p>",
+				"was-dir":         "file",
+			})
+			for _, dir := range []string{"/www/old", "/www/old/deep"} {
+				if _, err := srv.Fs.Stat(dir); !os.IsNotExist(err) {
+					t.Errorf("%s: not deleted", dir)
+				}
+			}
+
+			// Nothing changed, so nothing sent
+			before := len(srv.Commands())
+			if err := deploy.Run(context.Background(), opts); err != nil {
+				t.Fatal("repeating: ", err)
+			}
+			for _, c := range srv.Commands()[before:] {
+				if strings.HasPrefix(c, "STOR") || strings.HasPrefix(c, "DELE") || strings.HasPrefix(c, "RMD") {
+					t.Errorf("unchanged site, but the server was sent %s", c)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,808 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//Package ftptest provides an in-process FTP/FTPS server for exercising the
+//FTP deployer without a real webhost. Files live in an afero filesystem (in
+//memory by default) so they can be inspected directly, and Quirks reproduce
+//the differences between real servers that deployers have to cope with.
+package ftptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mindok/hugodeploy/deploy"
+	"github.com/spf13/afero"
+)
+
+//Quirks makes the server behave like particular real servers
+type Quirks struct {
+	MkdExistsReply   string //Reply when MKD names an existing directory. Default "550 <path>: File exists"
+	DeleMissingReply string //Reply when DELE names a missing file. Default "550 <path>: No such file or directory"
+	NoMLSD           bool   //MLSD and MLST are rejected as unknown commands
+	PassiveOnly      bool   //PORT and EPRT are refused, so only passive mode works
+	RequireTLS       bool   //USER is refused until AUTH TLS has been done
+	NoTLS            bool   //AUTH TLS is refused
+	NoChecksums      bool   //HASH, XSHA256, XSHA1, XMD5 and XCRC are rejected
+	NoChmod          bool   //SITE CHMOD is rejected
+	NoMFMT           bool   //MFMT is rejected
+}
+
+//Reply texts used by some common servers, for use in Quirks
+var (
+	//vsftpd gives the same reply whatever the reason for a failure
+	QUIRKS_VSFTPD = Quirks{
+		MkdExistsReply:   "550 Create directory operation failed.",
+		DeleMissingReply: "550 Delete operation failed.",
+		NoMLSD:           true,
+		NoChecksums:      true,
+		NoMFMT:           true,
+	}
+	QUIRKS_PUREFTPD = Quirks{
+		MkdExistsReply:   "550 Can't create directory: File exists",
+		DeleMissingReply: "550 Could not delete file: No such file or directory",
+	}
+	QUIRKS_FILEZILLA = Quirks{
+		MkdExistsReply:   "550 Directory already exists",
+		DeleMissingReply: "550 File not found",
+		RequireTLS:       true,
+	}
+)
+
+//Server is a minimal FTP server listening on the loopback interface. It
+//supports enough of RFC 959, 2228 (AUTH TLS), 2428 (EPSV/EPRT) and 3659
+//(MLSD, SIZE, MDTM) for FTPDeployer and typical FTP clients.
+type Server struct {
+	Fs       afero.Fs //Server contents. Paths are absolute within Fs
+	User     string
+	Password string
+	Quirks   Quirks
+
+	listener  net.Listener
+	tlsConfig *tls.Config
+	mu        sync.Mutex
+	log       []string
+	wg        sync.WaitGroup
+}
+
+//NewServer starts a server on a free loopback port with an empty in-memory
+//filesystem and user "test", password "test". Call Close when done.
+func NewServer(q Quirks) (*Server, error) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Fs:        afero.NewMemMapFs(),
+		User:      "test",
+		Password:  "test",
+		Quirks:    q,
+		listener:  l,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+//Addr is the host:port the server is listening on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+//Host is the address the server is listening on
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+	return host
+}
+
+//Port is the port the server is listening on
+func (s *Server) Port() string {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	return port
+}
+
+//Deployer returns an FTPDeployer set up to deploy to rootDir on this server.
+//TLS is used unless the server refuses it.
+func (s *Server) Deployer(rootDir string) *deploy.FTPDeployer {
+	return &deploy.FTPDeployer{
+		HostID:     s.Host(),
+		Port:       s.Port(),
+		UID:        s.User,
+		PWD:        s.Password,
+		RootDir:    rootDir,
+		DisableTLS: s.Quirks.NoTLS,
+	}
+}
+
+//Commands lists the commands received so far, oldest first. Passwords are
+//replaced with ****.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.log...)
+}
+
+//Close stops the server and waits for open sessions to finish
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			newSession(s, conn).run()
+		}()
+	}
+}
+
+func (s *Server) record(cmd, arg string) {
+	if cmd == "PASS" {
+		arg = "****"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log = append(s.log, strings.TrimSpace(cmd+" "+arg))
+}
+
+//session is one client's control connection
+type session struct {
+	srv        *Server
+	conn       net.Conn
+	r          *bufio.Reader
+	tls        bool
+	protected  bool //PROT P - data connections use TLS too
+	user       string
+	loggedIn   bool
+	cwd        string
+	renameFrom string
+	pasv       net.Listener
+	activeAddr string
+}
+
+func newSession(s *Server, conn net.Conn) *session {
+	return &session{srv: s, conn: conn, r: bufio.NewReader(conn), cwd: "/"}
+}
+
+func (c *session) reply(format string, args ...interface{}) {
+	fmt.Fprintf(c.conn, format+"\r\n", args...)
+}
+
+func (c *session) run() {
+	defer c.conn.Close()
+	defer c.closePasv()
+	c.reply("220 hugodeploy ftptest server ready")
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		cmd = strings.ToUpper(cmd)
+		c.srv.record(cmd, arg)
+		if !c.handle(cmd, arg) {
+			return
+		}
+	}
+}
+
+//handle carries out one command, returning false when the session is over
+func (c *session) handle(cmd, arg string) bool {
+	switch cmd {
+	case "QUIT":
+		c.reply("221 Goodbye")
+		return false
+	case "AUTH":
+		return c.auth(arg)
+	case "USER":
+		if c.srv.Quirks.RequireTLS && !c.tls {
+			c.reply("530 TLS required - use AUTH TLS first")
+			return true
+		}
+		c.user = arg
+		c.reply("331 Password required for %s", arg)
+		return true
+	case "PASS":
+		if c.user == c.srv.User && arg == c.srv.Password {
+			c.loggedIn = true
+			c.reply("230 User %s logged in", c.user)
+		} else {
+			c.reply("530 Login incorrect")
+		}
+		return true
+	case "PBSZ":
+		c.reply("200 PBSZ=0")
+		return true
+	case "PROT":
+		c.protected = strings.ToUpper(arg) == "P"
+		c.reply("200 Protection level set to %s", strings.ToUpper(arg))
+		return true
+	case "SYST":
+		c.reply("215 UNIX Type: L8")
+		return true
+	case "FEAT":
+		c.feat()
+		return true
+	case "NOOP":
+		c.reply("200 NOOP ok")
+		return true
+	}
+
+	if !c.loggedIn {
+		c.reply("530 Please login with USER and PASS")
+		return true
+	}
+
+	switch cmd {
+	case "OPTS", "MODE", "STRU", "TYPE":
+		c.reply("200 %s ok", cmd)
+	case "PWD", "XPWD":
+		c.reply("257 \"%s\" is the current directory", c.cwd)
+	case "CWD", "XCWD":
+		c.cwdTo(arg)
+	case "CDUP", "XCUP":
+		c.cwdTo("..")
+	case "PASV":
+		c.passive(false)
+	case "EPSV":
+		c.passive(true)
+	case "PORT", "EPRT":
+		c.active(cmd, arg)
+	case "STOR":
+		c.stor(arg)
+	case "RETR":
+		c.retr(arg)
+	case "SIZE":
+		c.size(arg)
+	case "MDTM":
+		c.mdtm(arg)
+	case "MKD", "XMKD":
+		c.mkd(arg)
+	case "RMD", "XRMD":
+		c.rmd(arg)
+	case "DELE":
+		c.dele(arg)
+	case "RNFR":
+		c.rnfr(arg)
+	case "RNTO":
+		c.rnto(arg)
+	case "LIST", "NLST":
+		c.list(cmd, arg)
+	case "SITE":
+		c.site(arg)
+	case "MFMT":
+		if c.srv.Quirks.NoMFMT {
+			c.reply("500 Unknown command")
+		} else {
+			c.mfmt(arg)
+		}
+	case "HASH", "XSHA256", "XSHA1", "XMD5", "XCRC":
+		if c.srv.Quirks.NoChecksums {
+			c.reply("500 Unknown command")
+		} else {
+			c.checksum(cmd, arg)
+		}
+	case "MLSD", "MLST":
+		if c.srv.Quirks.NoMLSD {
+			c.reply("500 Unknown command")
+		} else if cmd == "MLSD" {
+			c.list(cmd, arg)
+		} else {
+			c.mlst(arg)
+		}
+	default:
+		c.reply("502 Command not implemented")
+	}
+	return true
+}
+
+func (c *session) feat() {
+	feats := []string{"EPSV", "PASV", "SIZE", "MDTM", "UTF8"}
+	if !c.srv.Quirks.NoChecksums {
+		feats = append(feats, "HASH SHA-256*", "XSHA256", "XSHA1", "XMD5", "XCRC")
+	}
+	if !c.srv.Quirks.NoTLS {
+		feats = append(feats, "AUTH TLS", "PBSZ", "PROT")
+	}
+	if !c.srv.Quirks.NoMFMT {
+		feats = append(feats, "MFMT")
+	}
+	if !c.srv.Quirks.NoMLSD {
+		feats = append(feats, "MLST type*;size*;modify*;")
+	}
+	c.reply("211-Features:")
+	for _, f := range feats {
+		c.reply(" %s", f)
+	}
+	c.reply("211 End")
+}
+
+func (c *session) auth(arg string) bool {
+	if c.srv.Quirks.NoTLS {
+		c.reply("502 AUTH not supported")
+		return true
+	}
+	if a := strings.ToUpper(arg); a != "TLS" && a != "SSL" {
+		c.reply("504 AUTH %s not supported", arg)
+		return true
+	}
+	c.reply("234 AUTH %s ok", strings.ToUpper(arg))
+	tconn := tls.Server(c.conn, c.srv.tlsConfig)
+	if err := tconn.Handshake(); err != nil {
+		return false
+	}
+	c.conn = tconn
+	c.r = bufio.NewReader(tconn)
+	c.tls = true
+	return true
+}
+
+//resolve turns a client path into an absolute path within the filesystem
+func (c *session) resolve(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = c.cwd + "/" + p
+	}
+	return cleanPath(p)
+}
+
+func cleanPath(p string) string {
+	parts := []string{}
+	for _, part := range strings.Split(p, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			if len(parts) > 0 {
+				parts = parts[:len(parts)-1]
+			}
+		default:
+			parts = append(parts, part)
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func (c *session) notFound(p string) {
+	c.reply("550 %s: No such file or directory", p)
+}
+
+func (c *session) cwdTo(arg string) {
+	p := c.resolve(arg)
+	if fi, err := c.srv.Fs.Stat(p); err != nil || !fi.IsDir() {
+		c.notFound(arg)
+		return
+	}
+	c.cwd = p
+	c.reply("250 CWD command successful")
+}
+
+func (c *session) closePasv() {
+	if c.pasv != nil {
+		c.pasv.Close()
+		c.pasv = nil
+	}
+}
+
+func (c *session) passive(extended bool) {
+	c.closePasv()
+	c.activeAddr = ""
+	l, err := net.Listen("tcp", c.srv.Host()+":0")
+	if err != nil {
+		c.reply("425 Can't open passive connection: %v", err)
+		return
+	}
+	c.pasv = l
+	port := l.Addr().(*net.TCPAddr).Port
+	if extended {
+		c.reply("229 Entering Extended Passive Mode (|||%d|)", port)
+		return
+	}
+	c.reply("227 Entering Passive Mode (%s,%d,%d)", strings.Replace(c.srv.Host(), ".", ",", -1), port/256, port%256)
+}
+
+func (c *session) active(cmd, arg string) {
+	if c.srv.Quirks.PassiveOnly {
+		c.reply("502 Active mode not supported - use PASV")
+		return
+	}
+	c.closePasv()
+	var addr string
+	if cmd == "PORT" {
+		f := strings.Split(arg, ",")
+		if len(f) != 6 {
+			c.reply("501 Syntax error in PORT")
+			return
+		}
+		hi, _ := strconv.Atoi(f[4])
+		lo, _ := strconv.Atoi(f[5])
+		addr = net.JoinHostPort(strings.Join(f[:4], "."), strconv.Itoa(hi*256+lo))
+	} else {
+		// EPRT |proto|addr|port|
+		f := strings.Split(arg, arg[:1])
+		if len(arg) == 0 || len(f) != 5 {
+			c.reply("501 Syntax error in EPRT")
+			return
+		}
+		addr = net.JoinHostPort(f[2], f[3])
+	}
+	c.activeAddr = addr
+	c.reply("200 %s command successful", cmd)
+}
+
+//openData makes the data connection set up by the last PASV, EPSV, PORT or EPRT
+func (c *session) openData() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case c.pasv != nil:
+		c.pasv.(*net.TCPListener).SetDeadline(time.Now().Add(10 * time.Second))
+		conn, err = c.pasv.Accept()
+		c.closePasv()
+	case c.activeAddr != "":
+		conn, err = net.DialTimeout("tcp", c.activeAddr, 10*time.Second)
+		c.activeAddr = ""
+	default:
+		err = errors.New("use PASV or PORT first")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.protected {
+		tconn := tls.Server(conn, c.srv.tlsConfig)
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tconn
+	}
+	return conn, nil
+}
+
+//transfer runs fn over a data connection, sending the preliminary and
+//completion replies
+func (c *session) transfer(fn func(conn net.Conn) error) {
+	c.reply("150 Opening data connection")
+	conn, err := c.openData()
+	if err != nil {
+		c.reply("425 Can't open data connection: %v", err)
+		return
+	}
+	err = fn(conn)
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.reply("451 Transfer aborted: %v", err)
+		return
+	}
+	c.reply("226 Transfer complete")
+}
+
+func (c *session) stor(arg string) {
+	p := c.resolve(arg)
+	if fi, err := c.srv.Fs.Stat(parentPath(p)); err != nil || !fi.IsDir() {
+		c.closePasv()
+		c.reply("553 %s: No such file or directory", arg)
+		return
+	}
+	if fi, err := c.srv.Fs.Stat(p); err == nil && fi.IsDir() {
+		c.closePasv()
+		c.reply("553 %s: Is a directory", arg)
+		return
+	}
+	c.transfer(func(conn net.Conn) error {
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			return err
+		}
+		return afero.WriteFile(c.srv.Fs, p, data, 0644)
+	})
+}
+
+func (c *session) retr(arg string) {
+	p := c.resolve(arg)
+	data, err := afero.ReadFile(c.srv.Fs, p)
+	if err != nil {
+		c.closePasv()
+		c.notFound(arg)
+		return
+	}
+	c.transfer(func(conn net.Conn) error {
+		_, err := conn.Write(data)
+		return err
+	})
+}
+
+func (c *session) size(arg string) {
+	fi, err := c.srv.Fs.Stat(c.resolve(arg))
+	if err != nil || fi.IsDir() {
+		c.notFound(arg)
+		return
+	}
+	c.reply("213 %d", fi.Size())
+}
+
+func (c *session) mdtm(arg string) {
+	fi, err := c.srv.Fs.Stat(c.resolve(arg))
+	if err != nil {
+		c.notFound(arg)
+		return
+	}
+	c.reply("213 %s", fi.ModTime().UTC().Format("20060102150405"))
+}
+
+func (c *session) site(arg string) {
+	f := strings.SplitN(arg, " ", 3)
+	if strings.ToUpper(f[0]) != "CHMOD" || c.srv.Quirks.NoChmod {
+		c.reply("500 Unknown SITE command")
+		return
+	}
+	if len(f) != 3 {
+		c.reply("501 Usage: SITE CHMOD <mode> <path>")
+		return
+	}
+	mode, err := strconv.ParseUint(f[1], 8, 32)
+	if err != nil {
+		c.reply("501 Bad mode %s", f[1])
+		return
+	}
+	if err := c.srv.Fs.Chmod(c.resolve(f[2]), os.FileMode(mode)); err != nil {
+		c.notFound(f[2])
+		return
+	}
+	c.reply("200 SITE CHMOD command successful")
+}
+
+func (c *session) mfmt(arg string) {
+	f := strings.SplitN(arg, " ", 2)
+	if len(f) != 2 {
+		c.reply("501 Usage: MFMT <YYYYMMDDhhmmss> <path>")
+		return
+	}
+	t, err := time.Parse("20060102150405", f[0])
+	if err != nil {
+		c.reply("501 Bad time %s", f[0])
+		return
+	}
+	if err := c.srv.Fs.Chtimes(c.resolve(f[1]), t, t); err != nil {
+		c.notFound(f[1])
+		return
+	}
+	c.reply("213 Modify=%s; %s", f[0], f[1])
+}
+
+var checksumAlgorithms = map[string]string{
+	"HASH":    deploy.HASH_SHA256,
+	"XSHA256": deploy.HASH_SHA256,
+	"XSHA1":   deploy.HASH_SHA1,
+	"XMD5":    deploy.HASH_MD5,
+	"XCRC":    deploy.HASH_CRC32,
+}
+
+func (c *session) checksum(cmd, arg string) {
+	data, err := afero.ReadFile(c.srv.Fs, c.resolve(arg))
+	if err != nil {
+		c.notFound(arg)
+		return
+	}
+	sum, _ := deploy.HashData(checksumAlgorithms[cmd], data)
+	if cmd == "HASH" {
+		c.reply("213 SHA-256 0-%d %s %s", len(data), sum, arg)
+		return
+	}
+	c.reply("250 %s", strings.ToUpper(sum))
+}
+
+func (c *session) mkd(arg string) {
+	p := c.resolve(arg)
+	if _, err := c.srv.Fs.Stat(p); err == nil {
+		if c.srv.Quirks.MkdExistsReply != "" {
+			c.reply("%s", c.srv.Quirks.MkdExistsReply)
+		} else {
+			c.reply("550 %s: File exists", arg)
+		}
+		return
+	}
+	if fi, err := c.srv.Fs.Stat(parentPath(p)); err != nil || !fi.IsDir() {
+		c.notFound(arg)
+		return
+	}
+	if err := c.srv.Fs.Mkdir(p, 0755); err != nil {
+		c.reply("550 %s: %v", arg, err)
+		return
+	}
+	c.reply("257 \"%s\" directory created", p)
+}
+
+func (c *session) rmd(arg string) {
+	p := c.resolve(arg)
+	fi, err := c.srv.Fs.Stat(p)
+	if err != nil || !fi.IsDir() {
+		c.notFound(arg)
+		return
+	}
+	if names, _ := afero.ReadDir(c.srv.Fs, p); len(names) > 0 {
+		c.reply("550 %s: Directory not empty", arg)
+		return
+	}
+	if err := c.srv.Fs.Remove(p); err != nil {
+		c.reply("550 %s: %v", arg, err)
+		return
+	}
+	c.reply("250 RMD command successful")
+}
+
+func (c *session) dele(arg string) {
+	p := c.resolve(arg)
+	fi, err := c.srv.Fs.Stat(p)
+	if err != nil {
+		if c.srv.Quirks.DeleMissingReply != "" {
+			c.reply("%s", c.srv.Quirks.DeleMissingReply)
+		} else {
+			c.notFound(arg)
+		}
+		return
+	}
+	if fi.IsDir() {
+		c.reply("550 %s: Is a directory", arg)
+		return
+	}
+	if err := c.srv.Fs.Remove(p); err != nil {
+		c.reply("550 %s: %v", arg, err)
+		return
+	}
+	c.reply("250 DELE command successful")
+}
+
+func (c *session) rnfr(arg string) {
+	p := c.resolve(arg)
+	if _, err := c.srv.Fs.Stat(p); err != nil {
+		c.notFound(arg)
+		return
+	}
+	c.renameFrom = p
+	c.reply("350 File exists, ready for destination name")
+}
+
+func (c *session) rnto(arg string) {
+	if c.renameFrom == "" {
+		c.reply("503 Bad sequence of commands - use RNFR first")
+		return
+	}
+	from := c.renameFrom
+	c.renameFrom = ""
+	if err := c.srv.Fs.Rename(from, c.resolve(arg)); err != nil {
+		c.reply("550 Rename failed: %v", err)
+		return
+	}
+	c.reply("250 Rename successful")
+}
+
+func (c *session) list(cmd, arg string) {
+	// Ignore ls style options such as -la
+	if strings.HasPrefix(arg, "-") {
+		f := strings.Fields(arg)
+		arg = strings.Join(f[1:], " ")
+	}
+	p := c.resolve(arg)
+	fi, err := c.srv.Fs.Stat(p)
+	if err != nil {
+		c.closePasv()
+		c.notFound(arg)
+		return
+	}
+	infos := []os.FileInfo{fi}
+	if fi.IsDir() {
+		if infos, err = afero.ReadDir(c.srv.Fs, p); err != nil {
+			c.closePasv()
+			c.reply("550 %s: %v", arg, err)
+			return
+		}
+	}
+	c.transfer(func(conn net.Conn) error {
+		w := bufio.NewWriter(conn)
+		for _, fi := range infos {
+			switch cmd {
+			case "NLST":
+				fmt.Fprintf(w, "%s\r\n", fi.Name())
+			case "MLSD":
+				fmt.Fprintf(w, "%s\r\n", mlsxFacts(fi, fi.Name()))
+			default:
+				fmt.Fprintf(w, "%s 1 owner group %d %s %s\r\n", fi.Mode().String(), fi.Size(), fi.ModTime().Format("Jan _2 15:04"), fi.Name())
+			}
+		}
+		return w.Flush()
+	})
+}
+
+func (c *session) mlst(arg string) {
+	p := c.resolve(arg)
+	fi, err := c.srv.Fs.Stat(p)
+	if err != nil {
+		c.notFound(arg)
+		return
+	}
+	c.reply("250-Listing %s", arg)
+	c.reply(" %s", mlsxFacts(fi, p))
+	c.reply("250 End")
+}
+
+func mlsxFacts(fi os.FileInfo, name string) string {
+	kind := "file"
+	if fi.IsDir() {
+		kind = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s; %s", kind, fi.Size(), fi.ModTime().UTC().Format("20060102150405"), name)
+}
+
+func parentPath(p string) string {
+	if i := strings.LastIndex(p, "/"); i > 0 {
+		return p[:i]
+	}
+	return "/"
+}
+
+//selfSignedCert makes a throwaway certificate for AUTH TLS. FTPDeployer
+//doesn't verify server certificates so nothing more is needed.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ftptest"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
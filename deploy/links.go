@@ -0,0 +1,293 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/afero"
+	jww "github.com/spf13/jwalterweatherman"
+	"golang.org/x/net/html"
+)
+
+//BrokenLink is a reference in an HTML or CSS file to a page or asset of the
+//site that won't be on the target once the site is deployed
+type BrokenLink struct {
+	RelPath string //File holding the reference, relative to the website root
+	Line    int
+	Ref     string //The reference as written
+	Target  string //What it refers to, relative to the website root
+}
+
+func (b BrokenLink) String() string {
+	return fmt.Sprintf("%s:%d: %s not found (%s)", strings.TrimPrefix(b.RelPath, "/"), b.Line, b.Target, b.Ref)
+}
+
+//linkAttrs are the attributes of each element that refer to other pages or
+//assets
+var linkAttrs = map[string][]string{
+	"a":      {"href"},
+	"area":   {"href"},
+	"audio":  {"src"},
+	"embed":  {"src"},
+	"iframe": {"src"},
+	"img":    {"src", "srcset"},
+	"input":  {"src"},
+	"link":   {"href"},
+	"object": {"data"},
+	"script": {"src"},
+	"source": {"src", "srcset"},
+	"track":  {"src"},
+	"video":  {"src", "poster"},
+}
+
+var cssURL = regexp.MustCompile(`url\(\s*(?:"([^"]*)"|'([^']*)'|([^)\s]*))\s*\)|@import\s+(?:"([^"]*)"|'([^']*)')`)
+var cssComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+//CheckLinks parses the HTML and CSS files in opts.SourceDir and returns the
+//internal links, images, scripts, stylesheets etc. that refer to files that
+//won't exist on the target after a deploy. opts.SkipFiles and opts.Symlinks
+//are applied as a deploy would. baseURL, where the site is served from, lets
+//absolute links to the site itself be checked and root-relative links be
+//resolved when the site isn't at the root of its host. Links to other sites
+//aren't checked.
+func CheckLinks(ctx context.Context, opts Options, baseURL string) ([]BrokenLink, error) {
+	if opts.SourceDir == "" {
+		return nil, &Error{Op: OP_OPTIONS, Err: errors.New("SourceDir must be set")}
+	}
+	if opts.Symlinks == "" {
+		opts.Symlinks = SYMLINKS_FOLLOW
+	}
+	if err := CheckSymlinkPolicy(opts.Symlinks); err != nil {
+		return nil, &Error{Op: OP_OPTIONS, Err: err}
+	}
+	c := &linkChecker{root: &url.URL{Path: "/"}, files: make(map[string]bool), links: make(map[string]bool)}
+	if baseURL != "" {
+		root, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, &Error{Op: OP_OPTIONS, Err: fmt.Errorf("invalid baseURL %q: %v", baseURL, err)}
+		}
+		if !strings.HasSuffix(root.Path, "/") {
+			root.Path += "/"
+		}
+		c.root = root
+	}
+
+	scanner := newDeployScanner(ctx, opts.SourceFs, opts.SourceDir, nil, "", false, nil, opts.SkipFiles)
+	scanner.symlinks = opts.Symlinks
+	pages := []string{}
+	err := scanner.walkSource(opts.SourceDir, func(p string, info os.FileInfo) error {
+		if scanner.shouldSkip(p) {
+			return nil
+		}
+		rel := sitePath(scanner.getRelativePath(p))
+		switch {
+		case isSymlink(info):
+			// A preserved link, which may be to a directory we can't see into
+			c.links[rel] = true
+		case info.IsDir():
+			c.files[rel+"/"] = true
+		default:
+			c.files[rel] = true
+			switch strings.ToLower(filepath.Ext(p)) {
+			case ".html", ".htm", ".css":
+				pages = append(pages, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &Error{Op: OP_SCAN, Err: err}
+	}
+
+	for _, p := range pages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := afero.ReadFile(scanner.srcFs, p)
+		if err != nil {
+			return nil, &Error{Op: OP_SCAN, Path: p, Err: err}
+		}
+		rel := scanner.getRelativePath(p)
+		jww.DEBUG.Println("Checking links in ", rel)
+		page := c.root.ResolveReference(&url.URL{Path: sitePath(rel)})
+		if strings.ToLower(filepath.Ext(p)) == ".css" {
+			c.checkCSS(rel, page, string(data), 1)
+		} else if err := c.checkHTML(rel, page, data); err != nil {
+			return nil, &Error{Op: OP_SCAN, Path: p, Err: err}
+		}
+	}
+	return c.broken, nil
+}
+
+//sitePath turns a path relative to the website root into the form used by
+//linkChecker: slash separated, without a leading slash
+func sitePath(rel string) string {
+	return strings.TrimPrefix(filepath.ToSlash(rel), "/")
+}
+
+//linkChecker holds what will be on the target after a deploy, for checking
+//references against
+type linkChecker struct {
+	root   *url.URL        //Where the website root is served from
+	files  map[string]bool //Site paths of files, and of directories with a trailing slash
+	links  map[string]bool //Site paths of preserved symbolic links
+	broken []BrokenLink
+}
+
+//checkHTML checks the references in the HTML page rel, served at page
+func (c *linkChecker) checkHTML(rel string, page *url.URL, data []byte) error {
+	z := html.NewTokenizer(bytes.NewReader(data))
+	line, inStyle := 1, false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		}
+		// The token starts on line; work out where the next one does before
+		// Token invalidates Raw
+		start := line
+		line += bytes.Count(z.Raw(), []byte("\n"))
+		tok := z.Token()
+
+		switch tt {
+		case html.TextToken:
+			if inStyle {
+				c.checkCSS(rel, page, tok.Data, start)
+			}
+		case html.EndTagToken:
+			inStyle = false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			inStyle = tt == html.StartTagToken && tok.Data == "style"
+			if tok.Data == "base" {
+				if href, ok := attr(tok, "href"); ok {
+					if base, err := url.Parse(strings.TrimSpace(href)); err == nil {
+						page = page.ResolveReference(base)
+					}
+				}
+			}
+			for _, a := range tok.Attr {
+				switch {
+				case a.Key == "style":
+					c.checkCSS(rel, page, a.Val, start)
+				case a.Key == "srcset" && contains(linkAttrs[tok.Data], a.Key) && !strings.HasPrefix(strings.TrimSpace(a.Val), "data:"):
+					for _, candidate := range strings.Split(a.Val, ",") {
+						if f := strings.Fields(candidate); len(f) > 0 {
+							c.check(rel, start, page, f[0])
+						}
+					}
+				case contains(linkAttrs[tok.Data], a.Key):
+					c.check(rel, start, page, a.Val)
+				}
+			}
+		}
+	}
+}
+
+//checkCSS checks the url() and @import references in css, which starts on
+//line startLine of rel. They are relative to page.
+func (c *linkChecker) checkCSS(rel string, page *url.URL, css string, startLine int) {
+	// Blank out comments, keeping their line breaks so line numbers still work
+	css = cssComment.ReplaceAllStringFunc(css, func(s string) string {
+		return strings.Repeat("\n", strings.Count(s, "\n"))
+	})
+	for _, m := range cssURL.FindAllStringSubmatchIndex(css, -1) {
+		ref := ""
+		for i := 2; i < len(m); i += 2 {
+			if m[i] >= 0 {
+				ref = css[m[i]:m[i+1]]
+				break
+			}
+		}
+		c.check(rel, startLine+strings.Count(css[:m[0]], "\n"), page, ref)
+	}
+}
+
+//check records ref, found on line of rel, as broken if it is a reference
+//within the site to something that won't be there
+func (c *linkChecker) check(rel string, line int, page *url.URL, ref string) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		jww.DEBUG.Println("Not checking ", ref, " in ", rel, ": ", err)
+		return
+	}
+	target := page.ResolveReference(u)
+	if !strings.EqualFold(target.Host, c.root.Host) || (target.Scheme != "" && target.Scheme != "http" && target.Scheme != "https") {
+		return // Another site, or mailto:, data: etc
+	}
+	if !strings.HasPrefix(target.Path, c.root.Path) {
+		return // Elsewhere on the same host
+	}
+	p := strings.TrimPrefix(target.Path, c.root.Path)
+	if c.exists(p) {
+		return
+	}
+	if p == "" || strings.HasSuffix(p, "/") {
+		p += "index.html"
+	}
+	c.broken = append(c.broken, BrokenLink{RelPath: rel, Line: line, Ref: ref, Target: "/" + p})
+}
+
+//exists reports whether the site path p will be there. A directory counts
+//if it has an index.html, as that is what the server will give
+func (c *linkChecker) exists(p string) bool {
+	if p == "" || strings.HasSuffix(p, "/") {
+		return c.files[p+"index.html"]
+	}
+	if c.files[p] || (c.files[p+"/"] && c.files[p+"/index.html"]) {
+		return true
+	}
+	// Anything at or below a preserved link can't be checked
+	for link := range c.links {
+		if p == link || strings.HasPrefix(p, link+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func attr(tok html.Token, key string) (string, bool) {
+	for _, a := range tok.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,354 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+//LOCK_FILE is the lock file's name, in the deploy record directory and, with
+//Options.RemoteLock, in the website root on the target
+const LOCK_FILE = ".hugodeploy.lock"
+
+//DefaultStaleLockAge is how old a lock must be before it is taken over, when
+//Options.StaleLockAge isn't set
+const DefaultStaleLockAge = 2 * time.Hour
+
+//remoteLockSettle is how long to wait before reading back a remote lock, so
+//a push writing it at the same moment has finished
+const remoteLockSettle = time.Second
+
+//LockInfo is what a lock file holds
+type LockInfo struct {
+	Owner string    `json:"owner"`
+	Host  string    `json:"host"`
+	PID   int       `json:"pid"`
+	Start time.Time `json:"start"`
+	Token string    `json:"token"` //Tells the holder the lock is still its own
+}
+
+func (l LockInfo) String() string {
+	return fmt.Sprintf("%s@%s (pid %d), started %s", l.Owner, l.Host, l.PID, l.Start.Local().Format("2006-01-02 15:04:05"))
+}
+
+//LockedError is the Err of the *Error returned when another deployment
+//holds the lock
+type LockedError struct {
+	Where string //"deploy record" or "target"
+	Lock  LockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("another push holds the lock on the %s: %v (%v ago)", e.Where, e.Lock, time.Since(e.Lock.Start).Round(time.Second))
+}
+
+//deployLock is the locks held by one Session. The local lock in the deploy
+//record is taken when the session starts; the remote one, if wanted, once
+//connected.
+type deployLock struct {
+	opts   Options
+	info   LockInfo
+	local  string   //Path of the local lock file, once held
+	remote Deployer //Target holding the remote lock, once held
+}
+
+func newDeployLock(opts Options) *deployLock {
+	if opts.StaleLockAge == 0 {
+		opts.StaleLockAge = DefaultStaleLockAge
+	}
+	if opts.RemoteManifest {
+		// Pushes from several machines share the manifest
+		opts.RemoteLock = true
+	}
+	info := LockInfo{PID: os.Getpid(), Start: time.Now().UTC().Truncate(time.Second)}
+	info.Host, _ = os.Hostname()
+	if u, err := user.Current(); err == nil {
+		info.Owner = u.Username
+	}
+	token := make([]byte, 8)
+	rand.Read(token)
+	info.Token = hex.EncodeToString(token)
+	return &deployLock{opts: opts, info: info}
+}
+
+//lockLocal takes the lock file in the deploy record directory, if there is
+//one
+func (l *deployLock) lockLocal() error {
+	if l.opts.RecordDir == "" {
+		return nil
+	}
+	fs := osFsIfNil(l.opts.RecordFs)
+	p := filepath.Join(l.opts.RecordDir, LOCK_FILE)
+	data, err := json.MarshalIndent(l.info, "", "  ")
+	if err != nil {
+		return &Error{Op: OP_LOCK, Err: err}
+	}
+	if l.opts.ForceUnlock {
+		if err := fs.Remove(p); err == nil {
+			jww.FEEDBACK.Println("Removed lock ", p)
+		}
+	}
+	// Once more if a stale lock is removed
+	for i := 0; i < 2; i++ {
+		f, err := fs.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(data)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				fs.Remove(p)
+				return &Error{Op: OP_LOCK, Err: err}
+			}
+			l.local = p
+			return nil
+		}
+		if !os.IsExist(err) {
+			return &Error{Op: OP_LOCK, Err: err}
+		}
+		held, err := readLocalLock(fs, p)
+		if err != nil {
+			return &Error{Op: OP_LOCK, Err: err}
+		}
+		if reason := l.stale(held); reason != "" {
+			jww.FEEDBACK.Println("Taking over stale lock held by ", held, " - ", reason)
+			if err := fs.Remove(p); err != nil && !os.IsNotExist(err) {
+				return &Error{Op: OP_LOCK, Err: err}
+			}
+			continue
+		}
+		return &Error{Op: OP_LOCK, Err: &LockedError{Where: "deploy record", Lock: held}}
+	}
+	return &Error{Op: OP_LOCK, Err: errors.New("lost the race for the lock to another push")}
+}
+
+//readLocalLock reads a lock file. One that can't be understood, perhaps
+//written by a push that crashed part way, is dated by its modification time
+func readLocalLock(fs afero.Fs, p string) (LockInfo, error) {
+	var held LockInfo
+	data, err := afero.ReadFile(fs, p)
+	if err != nil {
+		return held, err
+	}
+	if json.Unmarshal(data, &held) != nil || held.Start.IsZero() {
+		fi, err := fs.Stat(p)
+		if err != nil {
+			return held, err
+		}
+		held = LockInfo{Owner: "unknown", Host: "unknown", Start: fi.ModTime()}
+	}
+	return held, nil
+}
+
+//stale gives the reason held can be taken over, or "" if it can't
+func (l *deployLock) stale(held LockInfo) string {
+	age := time.Since(held.Start)
+	if l.opts.StaleLockAge > 0 && age > l.opts.StaleLockAge {
+		return fmt.Sprintf("it is %v old", age.Round(time.Second))
+	}
+	if held.Host == l.info.Host && held.PID > 0 && !processAlive(held.PID) {
+		return fmt.Sprintf("process %d is no longer running", held.PID)
+	}
+	return ""
+}
+
+//processAlive reports whether a process with the given ID is running on
+//this machine
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess only succeeds for running processes
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, os.ErrPermission)
+}
+
+//lockRemote takes the lock file on target, if Options.RemoteLock is set.
+//Servers offer no way to create a file only if it doesn't exist, so the
+//lock is read back to check another push didn't write it at the same time.
+func (l *deployLock) lockRemote(target Deployer) error {
+	if !l.opts.RemoteLock || l.remote != nil {
+		return nil
+	}
+	dl, ok := target.(Downloader)
+	if !ok {
+		return &Error{Op: OP_LOCK, Err: fmt.Errorf("the %s deployer can't lock the target", target.GetName())}
+	}
+	held, exists, err := readRemoteLock(target, dl)
+	if err != nil {
+		return &Error{Op: OP_LOCK, Err: err}
+	}
+	if exists && held.Token != l.info.Token {
+		if reason := l.stale(held); l.opts.ForceUnlock {
+			jww.FEEDBACK.Println("Removing lock on the target held by ", held)
+		} else if reason != "" {
+			jww.FEEDBACK.Println("Taking over stale lock on the target held by ", held, " - ", reason)
+		} else {
+			return &Error{Op: OP_LOCK, Err: &LockedError{Where: "target", Lock: held}}
+		}
+	}
+
+	data, err := json.MarshalIndent(l.info, "", "  ")
+	if err != nil {
+		return &Error{Op: OP_LOCK, Err: err}
+	}
+	cmd := &DeployCommand{RelPath: string(filepath.Separator) + LOCK_FILE, Command: COMMAND_FILE_ADD, Contents: data, Size: int64(len(data))}
+	if exists {
+		cmd.Command = COMMAND_FILE_UPD
+	}
+	if err := target.ApplyCommand(cmd); err != nil {
+		return &Error{Op: OP_LOCK, Err: fmt.Errorf("can't write lock file on the target: %v", err)}
+	}
+	l.remote = target
+
+	time.Sleep(remoteLockSettle)
+	held, _, err = readRemoteLock(target, dl)
+	if err != nil {
+		return &Error{Op: OP_LOCK, Err: err}
+	}
+	if held.Token != l.info.Token {
+		l.remote = nil
+		return &Error{Op: OP_LOCK, Err: &LockedError{Where: "target", Lock: held}}
+	}
+	return nil
+}
+
+//readRemoteLock reads the lock file on target, reporting whether there is
+//one
+func readRemoteLock(target Deployer, dl Downloader) (LockInfo, bool, error) {
+	var held LockInfo
+	data, exists, err := readRemote(target, dl, LOCK_FILE)
+	if err != nil || !exists {
+		return held, false, err
+	}
+	if json.Unmarshal(data, &held) != nil {
+		held = LockInfo{Owner: "unknown", Host: "unknown"}
+	}
+	return held, true, nil
+}
+
+//readRemote downloads the file name from the website root on target,
+//reporting whether it is there. Targets that can list files are asked
+//first, so a missing file can be told apart from a failed download.
+func readRemote(target Deployer, dl Downloader, name string) ([]byte, bool, error) {
+	if lister, ok := target.(Lister); ok {
+		files, err := lister.List(string(filepath.Separator))
+		if err != nil {
+			return nil, false, err
+		}
+		found := false
+		for _, f := range files {
+			found = found || f.Name == name
+		}
+		if !found {
+			return nil, false, nil
+		}
+	}
+	data, err := dl.Download(string(filepath.Separator) + name)
+	if err != nil {
+		if _, ok := target.(Lister); ok {
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
+	return data, true, nil
+}
+
+//refresh brings the start time in the locks up to date once they are half
+//way to being taken over as stale, so a session kept open for hours, as by
+//Watch, keeps them. A remote lock that is no longer ours is dropped, to be
+//taken again, or reported as held by another push, on connecting.
+func (l *deployLock) refresh() error {
+	if l.opts.StaleLockAge <= 0 || time.Since(l.info.Start) < l.opts.StaleLockAge/2 {
+		return nil
+	}
+	l.info.Start = time.Now().UTC().Truncate(time.Second)
+	data, err := json.MarshalIndent(l.info, "", "  ")
+	if err != nil {
+		return &Error{Op: OP_LOCK, Err: err}
+	}
+	if l.local != "" {
+		if err := afero.WriteFile(osFsIfNil(l.opts.RecordFs), l.local, data, 0644); err != nil {
+			return &Error{Op: OP_LOCK, Err: err}
+		}
+	}
+	target := l.remote
+	if target == nil {
+		return nil
+	}
+	held, exists, err := readRemoteLock(target, target.(Downloader))
+	if err != nil {
+		return &Error{Op: OP_LOCK, Err: err}
+	}
+	if !exists || held.Token != l.info.Token {
+		l.remote = nil
+		return nil
+	}
+	cmd := &DeployCommand{RelPath: string(filepath.Separator) + LOCK_FILE, Command: COMMAND_FILE_UPD, Contents: data, Size: int64(len(data))}
+	if err := target.ApplyCommand(cmd); err != nil {
+		return &Error{Op: OP_LOCK, Err: fmt.Errorf("can't write lock file on the target: %v", err)}
+	}
+	return nil
+}
+
+//unlockRemote removes the lock file from the target, if this deployment
+//still holds it
+func (l *deployLock) unlockRemote() {
+	target := l.remote
+	if target == nil {
+		return
+	}
+	l.remote = nil
+	held, exists, err := readRemoteLock(target, target.(Downloader))
+	if err != nil {
+		jww.ERROR.Println("Can't check lock on the target: ", err)
+		return
+	}
+	if !exists || held.Token != l.info.Token {
+		jww.WARN.Println("Not removing lock on the target - it is no longer ours")
+		return
+	}
+	if err := target.ApplyCommand(&DeployCommand{RelPath: string(filepath.Separator) + LOCK_FILE, Command: COMMAND_FILE_DEL}); err != nil {
+		jww.ERROR.Println("Can't remove lock file on the target: ", err)
+	}
+}
+
+//unlockLocal removes the lock file from the deploy record directory
+func (l *deployLock) unlockLocal() {
+	if l.local == "" {
+		return
+	}
+	if err := osFsIfNil(l.opts.RecordFs).Remove(l.local); err != nil {
+		jww.ERROR.Println("Can't remove lock file: ", err)
+	}
+	l.local = ""
+}
@@ -0,0 +1,314 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+//MANIFEST_FILE is the manifest's name in the website root on the target,
+//with Options.RemoteManifest
+const MANIFEST_FILE = ".hugodeploy-manifest.json"
+
+//manifestVersion is the version of the manifest format written
+const manifestVersion = 1
+
+//Types of manifest entry
+const (
+	ENTRY_FILE = "file"
+	ENTRY_DIR  = "dir"
+	ENTRY_LINK = "link"
+)
+
+//manifestRoot stands in for the deploy record directory when scanning
+//against a manifest
+var manifestRoot = string(filepath.Separator)
+
+//Manifest lists what has been deployed: the hash and size of each file,
+//each directory and each symbolic link. With Options.RemoteManifest it is
+//kept on the target in place of a deploy record directory, so any machine
+//can work out what has changed since the last deployment.
+type Manifest struct {
+	Version   int                      `json:"version"`
+	Updated   time.Time                `json:"updated"`
+	UpdatedBy string                   `json:"updatedBy,omitempty"` //user@host of the last deployment
+	Entries   map[string]ManifestEntry `json:"entries"`             //By path relative to the website root, slash separated
+	dirty     bool                     //Changed since it was downloaded
+}
+
+//ManifestEntry is what was deployed at one path
+type ManifestEntry struct {
+	Type   string `json:"type"` //One of the ENTRY_ types
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"` //Of the file as sent, so after minifying
+	Target string `json:"target,omitempty"` //Where a link points
+}
+
+//NewManifest returns an empty manifest
+func NewManifest() *Manifest {
+	return &Manifest{Version: manifestVersion, Entries: make(map[string]ManifestEntry)}
+}
+
+//fetchManifest downloads the manifest from opts.Deployer. If there isn't one
+//yet it starts from opts.RecordDir where that exists, so switching from a
+//deploy record doesn't send everything again, and from nothing otherwise.
+func fetchManifest(opts Options) (*Manifest, error) {
+	dl, ok := opts.Deployer.(Downloader)
+	if !ok {
+		return nil, &Error{Op: OP_RECORD, Err: fmt.Errorf("the %s deployer can't keep a manifest on the target", opts.Deployer.GetName())}
+	}
+	data, exists, err := readRemote(opts.Deployer, dl, MANIFEST_FILE)
+	if err != nil {
+		return nil, &Error{Op: OP_RECORD, Path: MANIFEST_FILE, Err: err}
+	}
+	if exists {
+		m := NewManifest()
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, &Error{Op: OP_RECORD, Path: MANIFEST_FILE, Err: fmt.Errorf("%v - delete it from the target to send everything again", err)}
+		}
+		if m.Version > manifestVersion {
+			return nil, &Error{Op: OP_RECORD, Path: MANIFEST_FILE, Err: fmt.Errorf("written by a newer version of hugodeploy (format %d)", m.Version)}
+		}
+		if m.Entries == nil {
+			m.Entries = make(map[string]ManifestEntry)
+		}
+		jww.INFO.Println("Manifest on the target lists ", len(m.Entries), " paths, last updated ", m.Updated.Local(), " by ", m.UpdatedBy)
+		return m, nil
+	}
+
+	if opts.RecordDir != "" && checkDirExists(osFsIfNil(opts.RecordFs), opts.RecordDir, "Destination") == nil {
+		jww.FEEDBACK.Println("No manifest on the target - starting from the deploy record in ", opts.RecordDir)
+		m, err := manifestFromRecord(fsRecord{osFsIfNil(opts.RecordFs)}, opts.RecordDir)
+		if err != nil {
+			return nil, &Error{Op: OP_RECORD, Err: err}
+		}
+		return m, nil
+	}
+	jww.FEEDBACK.Println("No manifest on the target - everything will be sent")
+	m := NewManifest()
+	m.dirty = true
+	return m, nil
+}
+
+//manifestFromRecord lists what the deploy record directory dir holds
+func manifestFromRecord(record fsRecord, dir string) (*Manifest, error) {
+	m := NewManifest()
+	m.dirty = true
+	err := record.walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if key == "." || key == LOCK_FILE {
+			return nil
+		}
+		switch {
+		case isSymlink(info):
+			target, err := record.readlink(p)
+			if err != nil {
+				return err
+			}
+			m.Entries[key] = ManifestEntry{Type: ENTRY_LINK, Target: target}
+		case info.IsDir():
+			m.Entries[key] = ManifestEntry{Type: ENTRY_DIR}
+		default:
+			data, err := afero.ReadFile(record.fs, p)
+			if err != nil {
+				return err
+			}
+			m.Entries[key] = fileEntry(data)
+		}
+		return nil
+	})
+	return m, err
+}
+
+func fileEntry(data []byte) ManifestEntry {
+	sum, _ := HashData(HASH_SHA256, data)
+	return ManifestEntry{Type: ENTRY_FILE, Size: int64(len(data)), SHA256: sum}
+}
+
+//save uploads the manifest to target, noting the deployment holding lock
+//as the one that updated it
+func (m *Manifest) save(target Deployer, lock *deployLock) error {
+	m.Version = manifestVersion
+	m.Updated = time.Now().UTC().Truncate(time.Second)
+	m.UpdatedBy = lock.info.Owner + "@" + lock.info.Host
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return &Error{Op: OP_RECORD, Path: MANIFEST_FILE, Err: err}
+	}
+	cmd := &DeployCommand{RelPath: manifestRoot + MANIFEST_FILE, Command: COMMAND_FILE_UPD, Contents: data, Size: int64(len(data))}
+	if err := target.ApplyCommand(cmd); err != nil {
+		return &Error{Op: OP_RECORD, Path: MANIFEST_FILE, Err: fmt.Errorf("can't upload the manifest: %v", err)}
+	}
+	jww.INFO.Println("Uploaded manifest listing ", len(m.Entries), " paths")
+	m.dirty = false
+	return nil
+}
+
+//key gives the entry for p, a path below manifestRoot
+func (m *Manifest) key(p string) string {
+	return sitePath(strings.TrimPrefix(filepath.Clean(p), manifestRoot))
+}
+
+func (m *Manifest) lstat(p string) (os.FileInfo, error) {
+	key := m.key(p)
+	if key == "" {
+		return manifestInfo{name: manifestRoot, entry: ManifestEntry{Type: ENTRY_DIR}}, nil
+	}
+	e, ok := m.Entries[key]
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+	}
+	return manifestInfo{name: path.Base(key), entry: e}, nil
+}
+
+func (m *Manifest) readlink(p string) (string, error) {
+	e, ok := m.Entries[m.key(p)]
+	if !ok || e.Type != ENTRY_LINK {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: errors.New("not a symbolic link")}
+	}
+	return e.Target, nil
+}
+
+func (m *Manifest) holds(p string, data []byte) (bool, error) {
+	e, ok := m.Entries[m.key(p)]
+	if !ok || e.Type != ENTRY_FILE || e.Size != int64(len(data)) {
+		return false, nil
+	}
+	return fileEntry(data).SHA256 == e.SHA256, nil
+}
+
+//walk calls walkFn for root and everything listed below it, parents before
+//their contents
+func (m *Manifest) walk(root string, walkFn filepath.WalkFunc) error {
+	info, err := m.lstat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	if err := walkFn(root, info, nil); err != nil || !info.IsDir() {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	prefix := m.key(root)
+	if prefix != "" {
+		prefix += "/"
+	}
+	keys := []string{}
+	for key := range m.Entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	skip := ""
+	for _, key := range keys {
+		if skip != "" && strings.HasPrefix(key, skip) {
+			continue
+		}
+		e := m.Entries[key]
+		err := walkFn(filepath.Join(manifestRoot, filepath.FromSlash(key)), manifestInfo{name: path.Base(key), entry: e}, nil)
+		if err == filepath.SkipDir {
+			if e.Type == ENTRY_DIR {
+				skip = key + "/"
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//GetName, Initialise, ApplyCommand and Cleanup make a Manifest the recorder
+//for Plan.Apply, so it is kept in step with the target
+
+func (m *Manifest) GetName() string {
+	return "Manifest"
+}
+
+func (m *Manifest) Initialise() error {
+	return nil
+}
+
+func (m *Manifest) ApplyCommand(cmd *DeployCommand) error {
+	key := sitePath(cmd.RelPath)
+	switch cmd.Command {
+	case COMMAND_FILE_ADD, COMMAND_FILE_UPD:
+		m.Entries[key] = fileEntry(cmd.Contents)
+	case COMMAND_DIR_ADD:
+		m.Entries[key] = ManifestEntry{Type: ENTRY_DIR}
+	case COMMAND_LINK_ADD:
+		m.Entries[key] = ManifestEntry{Type: ENTRY_LINK, Target: cmd.LinkTarget}
+	case COMMAND_FILE_DEL:
+		delete(m.Entries, key)
+	case COMMAND_DIR_DEL:
+		delete(m.Entries, key)
+		for k := range m.Entries {
+			if strings.HasPrefix(k, key+"/") {
+				delete(m.Entries, k)
+			}
+		}
+	default:
+		return errors.New("Not implemented")
+	}
+	m.dirty = true
+	return nil
+}
+
+func (m *Manifest) Cleanup() error {
+	return nil
+}
+
+//manifestInfo describes a manifest entry as a file would be described
+type manifestInfo struct {
+	name  string
+	entry ManifestEntry
+}
+
+func (i manifestInfo) Name() string       { return i.name }
+func (i manifestInfo) Size() int64        { return i.entry.Size }
+func (i manifestInfo) ModTime() time.Time { return time.Time{} }
+func (i manifestInfo) IsDir() bool        { return i.entry.Type == ENTRY_DIR }
+func (i manifestInfo) Sys() interface{}   { return nil }
+
+func (i manifestInfo) Mode() os.FileMode {
+	switch i.entry.Type {
+	case ENTRY_DIR:
+		return os.ModeDir | 0755
+	case ENTRY_LINK:
+		return os.ModeSymlink | 0777
+	}
+	return 0644
+}
@@ -0,0 +1,68 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//PermissionRule gives files and directories matching Pattern (see MatchGlob)
+//the permissions Mode on the deployment target
+type PermissionRule struct {
+	Pattern string
+	Mode    os.FileMode
+}
+
+//ParsePermissionRule parses a rule written as a glob pattern followed by an
+//octal mode, e.g. "cgi-bin/** 0755"
+func ParsePermissionRule(s string) (PermissionRule, error) {
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return PermissionRule{}, fmt.Errorf("permission rule %q should be a pattern then an octal mode, e.g. \"cgi-bin/** 0755\"", s)
+	}
+	mode, err := strconv.ParseUint(f[1], 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return PermissionRule{}, fmt.Errorf("permission rule %q: %s is not an octal mode between 0001 and 0777", s, f[1])
+	}
+	return PermissionRule{Pattern: f[0], Mode: os.FileMode(mode)}, nil
+}
+
+//ParsePermissionRules parses a list of rules, as found in the config file
+func ParsePermissionRules(rules []string) ([]PermissionRule, error) {
+	parsed := make([]PermissionRule, 0, len(rules))
+	for _, r := range rules {
+		p, err := ParsePermissionRule(r)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+//permissionFor finds the mode for relPath. Later rules override earlier ones,
+//and 0 means no rule matched so the target's default applies.
+func permissionFor(rules []PermissionRule, relPath string) os.FileMode {
+	var mode os.FileMode
+	for _, r := range rules {
+		if MatchGlob(r.Pattern, relPath) {
+			mode = r.Mode
+		}
+	}
+	return mode
+}
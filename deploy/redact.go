@@ -0,0 +1,117 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+//RedactedMask replaces secrets in anything that gets logged.
+const RedactedMask = "********"
+
+var secrets = struct {
+	sync.RWMutex
+	values []string
+}{}
+
+//RegisterSecret marks s as secret so it is masked in all output passed
+//through Redact or a redacting writer. Call it as soon as a password,
+//passphrase or token is known - before it can be logged.
+func RegisterSecret(s string) {
+	if s == "" {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, v := range secrets.values {
+		if v == s {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, s)
+}
+
+//Redact returns s with every registered secret masked.
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, v := range secrets.values {
+		s = strings.Replace(s, v, RedactedMask, -1)
+	}
+	return s
+}
+
+//IsSecretKey reports whether a config key holds a credential that must not be
+//printed, e.g. ftp.pwd or environments.staging.sftp.passphrase
+func IsSecretKey(key string) bool {
+	k := strings.ToLower(key)
+	if i := strings.LastIndex(k, "."); i >= 0 {
+		k = k[i+1:]
+	}
+	switch k {
+	case "pwd", "password", "passphrase", "token", "secret":
+		return true
+	}
+	return false
+}
+
+//RedactSetting returns value, or the mask if key is a secret config key.
+func RedactSetting(key string, value interface{}) interface{} {
+	if IsSecretKey(key) {
+		if s, ok := value.(string); ok && s == "" {
+			return ""
+		}
+		return RedactedMask
+	}
+	return value
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+//NewRedactingWriter wraps w so registered secrets are masked before they are
+//written. Loggers write a line per call so secrets are never split between
+//writes.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return &redactingWriter{w}
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//RedactLogging routes jww's stdout output (normally os.Stdout) to w and the
+//standard library logger, which the FTP library uses for its debug trace, to
+//os.Stderr, both through redacting writers. jww doesn't move FEEDBACK when
+//its output or thresholds change, so call this again after setting them.
+//Anything written to a jww log file should be wrapped with NewRedactingWriter
+//before being passed to jww.SetLogOutput.
+func RedactLogging(w io.Writer) {
+	rw := NewRedactingWriter(w)
+	jww.SetStdoutOutput(rw)
+	jww.FEEDBACK = jww.NewNotepad(jww.LevelError, jww.LevelWarn, rw, ioutil.Discard, "", 0).FEEDBACK
+	log.SetOutput(NewRedactingWriter(os.Stderr))
+}
@@ -0,0 +1,128 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//RemoteFile describes a file or directory found on a deployment target
+type RemoteFile struct {
+	Name    string //Base name, not the full path
+	Size    int64
+	ModTime time.Time //Zero if the target doesn't say
+	IsDir   bool
+}
+
+//Lister is implemented by Deployers that can report what is on the target.
+//relDir is relative to the website root, as for DeployCommand.RelPath. Only
+//call List after a successful Initialise.
+type Lister interface {
+	List(relDir string) ([]RemoteFile, error)
+}
+
+//Checksummer is implemented by Deployers that can checksum a file on the
+//target without downloading it. The algorithm depends on what the target
+//supports; use HashData with the same algorithm to compare local data.
+//ErrChecksumUnsupported is returned when the target can't checksum at all.
+type Checksummer interface {
+	Checksum(relPath string) (algorithm string, sum string, err error)
+}
+
+var ErrChecksumUnsupported = errors.New("checksums not supported by this server")
+
+//Checksum algorithms, as returned by Checksummer
+const (
+	HASH_SHA256 = "sha256"
+	HASH_SHA1   = "sha1"
+	HASH_MD5    = "md5"
+	HASH_CRC32  = "crc32"
+)
+
+//HashData checksums data with the named algorithm, giving the lower case hex
+//form returned by Checksummer
+func HashData(algorithm string, data []byte) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case HASH_SHA256:
+		h = sha256.New()
+	case HASH_SHA1:
+		h = sha1.New()
+	case HASH_MD5:
+		h = md5.New()
+	case HASH_CRC32:
+		h = crc32.NewIEEE()
+	default:
+		return "", fmt.Errorf("unknown checksum algorithm %q", algorithm)
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//parseListLine parses a line of Unix style LIST output, e.g.
+//  -rw-r--r--   1 owner group   1234 Jan  2 15:04 index.html
+//  drwxr-xr-x   2 owner group   4096 Jan  2  2006 images
+//Returns false for lines that aren't entries, such as "total 12".
+func parseListLine(line string, now time.Time) (RemoteFile, bool) {
+	f := strings.Fields(line)
+	if len(f) < 9 || len(f[0]) < 10 {
+		return RemoteFile{}, false
+	}
+	size, err := strconv.ParseInt(f[4], 10, 64)
+	if err != nil {
+		return RemoteFile{}, false
+	}
+	// The name is everything after the date, and may contain spaces
+	name := line
+	for i := 0; i < 8; i++ {
+		name = strings.TrimLeft(name, " ")
+		name = name[strings.IndexByte(name, ' ')+1:]
+	}
+	name = strings.TrimLeft(name, " ")
+	if f[0][0] == 'l' {
+		if i := strings.Index(name, " -> "); i >= 0 {
+			name = name[:i]
+		}
+	}
+	if name == "." || name == ".." {
+		return RemoteFile{}, false
+	}
+
+	// Recent files show the time but not the year
+	var mtime time.Time
+	date := f[5] + " " + f[6] + " " + f[7]
+	if strings.Contains(f[7], ":") {
+		if t, err := time.Parse("Jan 2 15:04", date); err == nil {
+			mtime = t.AddDate(now.Year(), 0, 0)
+			if mtime.After(now.Add(24 * time.Hour)) {
+				mtime = mtime.AddDate(-1, 0, 0)
+			}
+		}
+	} else if t, err := time.Parse("Jan 2 2006", date); err == nil {
+		mtime = t
+	}
+
+	return RemoteFile{Name: name, Size: size, ModTime: mtime, IsDir: f[0][0] == 'd'}, true
+}
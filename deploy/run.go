@@ -0,0 +1,310 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+//Options configures a deployment made with Run or MakePlan
+type Options struct {
+	SourceDir string     //Directory holding the files to deploy
+	RecordDir string     //Directory holding a copy of what has been deployed. Optional with RemoteManifest
+	SourceFs  afero.Fs   //Filesystem holding SourceDir. Defaults to the operating system's
+	RecordFs  afero.Fs   //Filesystem holding RecordDir. Defaults to the operating system's
+	Minify    bool       //Minify html, css, js etc before comparing & sending
+	SkipFiles []string   //Paths containing any of these are ignored
+	Deployer  Deployer   //Deployment target. Run initialises and cleans it up
+	Observers []Observer //Told about progress as the deployment runs
+
+	//Verify checks each upload arrived intact before recording it, resending
+	//up to VerifyRetries times if it didn't
+	Verify        bool
+	VerifyRetries int
+
+	Permissions     []string //Rules such as "cgi-bin/** 0755" - see ParsePermissionRule
+	PreserveModTime bool     //Give uploaded files the modification time of the source
+
+	Symlinks string //How to treat symbolic links in SourceDir - one of the SYMLINKS_ policies. Defaults to SYMLINKS_FOLLOW
+
+	Budgets Budgets //Limits on file and deployment sizes, checked before files are read
+
+	//A lock file in RecordDir stops two deployments from the same machine
+	//running at once. RemoteLock adds one on the target, for deployments
+	//from several machines. Locks older than StaleLockAge (default
+	//DefaultStaleLockAge, negative for never) or left by a process that has
+	//gone are taken over. ForceUnlock removes any existing locks first.
+	RemoteLock   bool
+	StaleLockAge time.Duration
+	ForceUnlock  bool
+
+	//RemoteManifest keeps a Manifest of what has been deployed on the target,
+	//as MANIFEST_FILE, in place of RecordDir, so any machine can deploy just
+	//what has changed. If the target has no manifest yet, it is started from
+	//RecordDir where given. Implies RemoteLock.
+	RemoteManifest bool
+
+	//BeforeConnect is called with the plan before connecting to Deployer,
+	//when there is something to deploy. With RemoteManifest the connection
+	//is already made, to fetch the manifest. Returning an error stops the
+	//deployment with nothing sent.
+	BeforeConnect func(plan *Plan) error
+
+	//AfterApply is called with the plan once every command has been applied,
+	//e.g. to check the live site. Returning an error fails the deployment,
+	//though what was sent stays recorded as deployed.
+	AfterApply func(plan *Plan) error
+}
+
+//Op identifies the step of a deployment that failed
+type Op string
+
+const (
+	OP_OPTIONS Op = "options"
+	OP_LOCK    Op = "lock"
+	OP_SCAN    Op = "scan"
+	OP_BUDGET  Op = "budget"
+	OP_HOOK    Op = "hook"
+	OP_CONNECT Op = "connect"
+	OP_APPLY   Op = "apply"
+	OP_VERIFY  Op = "verify"
+	OP_RECORD  Op = "record"
+	OP_CHECK   Op = "check"
+	OP_CLEANUP Op = "cleanup"
+)
+
+//Error is the error type returned by Run, MakePlan and Plan.Apply. If the
+//deployment was cancelled, Err is the context's error so
+//errors.Is(err, context.Canceled) works as expected.
+type Error struct {
+	Op   Op
+	Path string //Relative path of the file being processed, if any
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("%s %s: %v", e.Op, e.Path, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//Plan is the list of commands needed to bring the deployment target into
+//line with the source directory. File contents aren't held in the plan - they
+//are read (and minified) again as each command is applied.
+type Plan struct {
+	Commands   []*DeployCommand
+	Violations []BudgetViolation //Budgets exceeded. Any that fail stop the plan being deployed
+	scanner    *DeployScanner
+	observers  observers
+	summary    *Summary
+
+	verify        bool
+	verifyRetries int
+}
+
+//MakePlan compares opts.SourceDir with opts.RecordDir, or with the manifest
+//on opts.Deployer if opts.RemoteManifest is set, and works out what needs to
+//be sent to the deployment target. Nothing is changed.
+func MakePlan(ctx context.Context, opts Options) (*Plan, error) {
+	if !opts.RemoteManifest {
+		return makePlan(ctx, opts, "", nil)
+	}
+	if opts.Deployer == nil {
+		return nil, &Error{Op: OP_OPTIONS, Err: errors.New("no Deployer given to fetch the manifest from")}
+	}
+	if err := opts.Deployer.Initialise(); err != nil {
+		return nil, &Error{Op: OP_CONNECT, Err: err}
+	}
+	manifest, err := fetchManifest(opts)
+	if cerr := opts.Deployer.Cleanup(); cerr != nil && err == nil {
+		err = &Error{Op: OP_CLEANUP, Err: cerr}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return makePlan(ctx, opts, "", manifest)
+}
+
+//makePlan is MakePlan for just relDir, a directory below opts.SourceDir,
+//comparing with manifest if given. An empty relDir means the whole of it.
+func makePlan(ctx context.Context, opts Options, relDir string, manifest *Manifest) (*Plan, error) {
+	if opts.SourceDir == "" || (opts.RecordDir == "" && manifest == nil) {
+		return nil, &Error{Op: OP_OPTIONS, Err: errors.New("SourceDir and RecordDir must both be set")}
+	}
+
+	p := &Plan{observers: opts.Observers, summary: newSummary(), verify: opts.Verify, verifyRetries: opts.VerifyRetries}
+	if opts.Symlinks == "" {
+		opts.Symlinks = SYMLINKS_FOLLOW
+	}
+	if err := CheckSymlinkPolicy(opts.Symlinks); err != nil {
+		return nil, &Error{Op: OP_OPTIONS, Err: err}
+	}
+	rules, err := ParsePermissionRules(opts.Permissions)
+	if err != nil {
+		return nil, &Error{Op: OP_OPTIONS, Err: err}
+	}
+	budgets, err := parseBudgets(opts.Budgets)
+	if err != nil {
+		return nil, &Error{Op: OP_OPTIONS, Err: err}
+	}
+	collect := func(cmd *DeployCommand) error {
+		cmd.Contents = nil
+		if cmd.Command == COMMAND_DIR_ADD || cmd.IsFileCommand() {
+			cmd.Mode = permissionFor(rules, cmd.RelPath)
+		}
+		if !opts.PreserveModTime {
+			cmd.ModTime = time.Time{}
+		}
+		p.Commands = append(p.Commands, cmd)
+		return nil
+	}
+	record, recordDir := recordFor(opts, manifest)
+	p.scanner = newDeployScanner(ctx, opts.SourceFs, opts.SourceDir, nil, recordDir, opts.Minify, collect, opts.SkipFiles)
+	p.scanner.record = record
+	p.scanner.observers = p.observers
+	p.scanner.symlinks = opts.Symlinks
+	p.scanner.budgets = budgets
+	p.observers.notify(&Event{Type: EVENT_SCAN_START})
+	dst, src := recordDir, opts.SourceDir
+	if relDir != "" {
+		dst, src = filepath.Join(dst, relDir), filepath.Join(src, relDir)
+	}
+	if err := p.scanner.Sync(dst, src); err != nil {
+		return nil, &Error{Op: OP_SCAN, Err: err}
+	}
+	p.Violations = p.scanner.violations
+	p.observers.notify(&Event{Type: EVENT_SCAN_FINISH, Plan: p})
+	return p, nil
+}
+
+//recordFor gives what the scanner compares the source with: manifest if
+//given, otherwise the deploy record directory
+func recordFor(opts Options, manifest *Manifest) (recordState, string) {
+	if manifest != nil {
+		return manifest, manifestRoot
+	}
+	return fsRecord{osFsIfNil(opts.RecordFs)}, opts.RecordDir
+}
+
+//SourceData returns what is sent for a file command: the source file,
+//minified if Options.Minify is set
+func (p *Plan) SourceData(cmd *DeployCommand) ([]byte, error) {
+	if cmd.srcPath == "" {
+		return nil, fmt.Errorf("%s has no source file", cmd.RelPath)
+	}
+	return p.scanner.getSourceData(cmd.srcPath)
+}
+
+//Summary returns the totals for the commands applied so far
+func (p *Plan) Summary() *Summary {
+	p.summary.Elapsed = time.Since(p.summary.Start)
+	return p.summary
+}
+
+//Apply sends each command in the plan to target and, once it has succeeded,
+//to recorder so the deploy record stays in step with the target. It stops at
+//the first failure, or before the next command once ctx is cancelled.
+func (p *Plan) Apply(ctx context.Context, target Deployer, recorder Deployer) error {
+	for _, cmd := range p.Commands {
+		if err := ctx.Err(); err != nil {
+			return &Error{Op: OP_APPLY, Path: cmd.RelPath, Err: err}
+		}
+		p.observers.notify(&Event{Type: EVENT_COMMAND_START, RelPath: cmd.RelPath, Command: cmd})
+		if err := p.apply(cmd, target, recorder); err != nil {
+			p.summary.Failed++
+			p.observers.notify(&Event{Type: EVENT_COMMAND_FAILURE, RelPath: cmd.RelPath, Command: cmd, Err: err})
+			return err
+		}
+		p.summary.Commands[cmd.Command]++
+		p.observers.notify(&Event{Type: EVENT_COMMAND_SUCCESS, RelPath: cmd.RelPath, Command: cmd})
+	}
+	return nil
+}
+
+func (p *Plan) apply(cmd *DeployCommand, target Deployer, recorder Deployer) error {
+	if cmd.IsFileCommand() && cmd.Contents == nil && cmd.srcPath != "" {
+		data, err := p.scanner.getSourceData(cmd.srcPath)
+		if err != nil {
+			return &Error{Op: OP_SCAN, Path: cmd.RelPath, Err: err}
+		}
+		cmd.Contents = data
+		defer func() { cmd.Contents = nil }()
+	}
+	for attempt := 0; ; attempt++ {
+		if err := target.ApplyCommand(cmd); err != nil {
+			return &Error{Op: OP_APPLY, Path: cmd.RelPath, Err: err}
+		}
+		if !cmd.IsFileCommand() {
+			break
+		}
+		n := int64(len(cmd.Contents))
+		p.summary.BytesTransferred += n
+		if cmd.SourceSize > n && attempt == 0 {
+			p.summary.BytesSaved += cmd.SourceSize - n
+		}
+		p.observers.notify(&Event{Type: EVENT_BYTES_TRANSFERRED, RelPath: cmd.RelPath, Command: cmd, Bytes: n})
+
+		if !p.verify {
+			break
+		}
+		err := verifyUpload(target, cmd)
+		if err == nil {
+			break
+		}
+		if _, mismatch := err.(*VerifyError); !mismatch || attempt >= p.verifyRetries {
+			return &Error{Op: OP_VERIFY, Path: cmd.RelPath, Err: err}
+		}
+		jww.WARN.Println(err, " - sending again")
+		p.summary.Retries++
+	}
+	// Permissions are for the target. The record just needs to stay readable
+	record := *cmd
+	record.Mode = 0
+	if err := recorder.ApplyCommand(&record); err != nil {
+		return &Error{Op: OP_RECORD, Path: cmd.RelPath, Err: err}
+	}
+	return nil
+}
+
+//Run works out what has changed between opts.SourceDir and opts.RecordDir and
+//applies those changes to opts.Deployer, updating opts.RecordDir as it goes.
+//With opts.RemoteManifest, the manifest on opts.Deployer takes the place of
+//opts.RecordDir and is uploaded again at the end. It is a Session used for
+//one Deploy of everything.
+//It never panics or exits; all failures are returned as *Error.
+func Run(ctx context.Context, opts Options) (err error) {
+	s, err := NewSession(opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := s.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	return s.Deploy(ctx, "")
+}
@@ -21,7 +21,10 @@ package deploy
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"github.com/spf13/afero"
 	jww "github.com/spf13/jwalterweatherman"
 	"github.com/tdewolff/minify"
 	"github.com/tdewolff/minify/css"
@@ -30,12 +33,11 @@ import (
 	"github.com/tdewolff/minify/json"
 	"github.com/tdewolff/minify/svg"
 	"github.com/tdewolff/minify/xml"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strings"
+	"syscall"
 )
 
 var filetypeMime = map[string]string{
@@ -53,8 +55,18 @@ type DeployScanner struct {
 	handleFunc commandHandler
 	srcDir     string
 	dstDir     string
+	srcFs      afero.Fs    //Filesystem holding srcDir
+	record     recordState //What has been deployed, below dstDir
 	skipFiles  []string
 	minifier   *minify.M
+	ctx        context.Context
+	observers  observers
+	symlinks   string   //One of the SYMLINKS_ policies
+	newDirs    []string //Destination files and links being replaced by directories. Nothing below them has been deployed
+	goneDirs   []string //Destination directories already deleted, with their contents, to make way for something else
+	budgets    *budgets //Size limits, if any
+	violations []BudgetViolation
+	sent       int64 //Source bytes of the files to be added or updated, for the total budget
 }
 
 //DeployChanges recursively walks through srcDir and compares each file with the equivalent
@@ -63,9 +75,25 @@ type DeployScanner struct {
 //command. DeployChanges then walks the dstDir to see if there are any files there which are not
 //in srcDir, in which case handleFunc is called with a DEL command
 func DeployChanges(srcDir string, dstDir string, minify bool, handleFunc commandHandler, skipFiles []string) error {
-	deployer := &DeployScanner{minify, handleFunc, srcDir, dstDir, skipFiles, nil}
-	deployer.initM()
-	return deployer.Sync(dstDir, srcDir)
+	return newDeployScanner(context.Background(), nil, srcDir, nil, dstDir, minify, handleFunc, skipFiles).Sync(dstDir, srcDir)
+}
+
+//newDeployScanner creates a scanner comparing srcDir on srcFs with dstDir on
+//dstFs. A nil filesystem means the operating system's.
+func newDeployScanner(ctx context.Context, srcFs afero.Fs, srcDir string, dstFs afero.Fs, dstDir string, minify bool, handleFunc commandHandler, skipFiles []string) *DeployScanner {
+	d := &DeployScanner{
+		minify:     minify,
+		handleFunc: handleFunc,
+		srcDir:     srcDir,
+		dstDir:     dstDir,
+		srcFs:      osFsIfNil(srcFs),
+		record:     fsRecord{osFsIfNil(dstFs)},
+		skipFiles:  skipFiles,
+		ctx:        ctx,
+		symlinks:   SYMLINKS_FOLLOW,
+	}
+	d.initM()
+	return d
 }
 
 func (d *DeployScanner) initM() {
@@ -81,41 +109,52 @@ func (d *DeployScanner) initM() {
 // Sync copies files and directories inside src into dst.
 func (d *DeployScanner) Sync(dst, src string) error {
 	// make sure src & destination exist
-	err := checkDirExists(src, "Source")
+	err := checkDirExists(d.srcFs, src, "Source")
 	if err != nil {
 		return err
 	}
 
-	err = checkDirExists(dst, "Destination")
+	dstat, err := d.record.lstat(dst)
 	if err != nil {
 		return err
 	}
+	if !dstat.IsDir() {
+		return errors.New("Destination must be a directory")
+	}
 
-	return d.syncRecover(dst, src)
-}
-
-// syncRecover handles errors and calls sync
-func (d *DeployScanner) syncRecover(dst, src string) (err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			if _, ok := r.(runtime.Error); ok {
-				panic(r)
-			}
-			err = r.(error)
-		}
-	}()
-
-	d.sync(dst, src)
+	if err := d.sync(dst, src); err != nil {
+		return err
+	}
+	d.checkTotalBudget()
 	return nil
 }
 
+//getRelativePath gives the path of src, which is inside srcDir, relative to
+//the website root, with a leading separator
 func (d *DeployScanner) getRelativePath(src string) string {
-	s := strings.Replace(src, d.srcDir, "", 1)
 	sep := string(os.PathSeparator)
-	if !strings.HasPrefix(s, sep) {
-		s = sep + s
+	rel, err := filepath.Rel(d.srcDir, src)
+	if err != nil {
+		// Only when one is absolute and the other isn't, which the walk never gives
+		jww.ERROR.Println("Can't find ", src, " relative to ", d.srcDir, ": ", err)
+		rel = strings.TrimPrefix(src, d.srcDir)
+	}
+	if rel == "." {
+		rel = ""
 	}
-	return s
+	return sep + strings.TrimPrefix(rel, sep)
+}
+
+//rebase maps path, which is inside from, to the same place inside to
+func rebase(path, from, to string) (string, error) {
+	rel, err := filepath.Rel(from, path)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not inside %s", path, from)
+	}
+	return filepath.Join(to, rel), nil
 }
 
 //TODO: Improve implementation - this is rather naive
@@ -129,29 +168,44 @@ func (d *DeployScanner) shouldSkip(path string) bool {
 }
 
 func (d *DeployScanner) makeCreateDirCmd(src string) *DeployCommand {
-	return &DeployCommand{d.getRelativePath(src), nil, COMMAND_DIR_ADD}
+	return &DeployCommand{RelPath: d.getRelativePath(src), Command: COMMAND_DIR_ADD}
 }
 
 func (d *DeployScanner) makeDeleteDirCmd(src string) *DeployCommand {
-	return &DeployCommand{d.getRelativePath(src), nil, COMMAND_DIR_DEL}
+	return &DeployCommand{RelPath: d.getRelativePath(src), Command: COMMAND_DIR_DEL}
 }
 
-func (d *DeployScanner) makeCreateFileCmd(src string, data []byte) *DeployCommand {
+func (d *DeployScanner) makeCreateFileCmd(src string, data []byte, sstat os.FileInfo) *DeployCommand {
 	//TODO: Unpack files, fix up paths, minify source
-	return &DeployCommand{d.getRelativePath(src), data, COMMAND_FILE_ADD}
+	return &DeployCommand{RelPath: d.getRelativePath(src), Contents: data, Command: COMMAND_FILE_ADD, Size: int64(len(data)), SourceSize: sstat.Size(), ModTime: sstat.ModTime(), srcPath: src}
+}
+
+func (d *DeployScanner) makeCreateLinkCmd(src string, target string) *DeployCommand {
+	return &DeployCommand{RelPath: d.getRelativePath(src), Command: COMMAND_LINK_ADD, LinkTarget: target}
 }
 
 func (d *DeployScanner) makeDeleteFileCmd(src string) *DeployCommand {
-	return &DeployCommand{d.getRelativePath(src), nil, COMMAND_FILE_DEL}
+	return &DeployCommand{RelPath: d.getRelativePath(src), Command: COMMAND_FILE_DEL}
 }
 
-func (d *DeployScanner) makeUpdateFileCmd(src string, data []byte) *DeployCommand {
+func (d *DeployScanner) makeUpdateFileCmd(src string, data []byte, sstat os.FileInfo) *DeployCommand {
 	//TODO: Unpack files, fix up paths, minify source
-	return &DeployCommand{d.getRelativePath(src), data, COMMAND_FILE_UPD}
+	return &DeployCommand{RelPath: d.getRelativePath(src), Contents: data, Command: COMMAND_FILE_UPD, Size: int64(len(data)), SourceSize: sstat.Size(), ModTime: sstat.ModTime(), srcPath: src}
+}
+
+// handle passes cmd to the handler function unless the scan has been cancelled
+func (d *DeployScanner) handle(cmd *DeployCommand) error {
+	if err := d.ctx.Err(); err != nil {
+		return err
+	}
+	if cmd.IsFileCommand() {
+		d.sent += cmd.SourceSize
+	}
+	return d.handleFunc(cmd)
 }
 
 // sync updates dst to match with src, handling both files and directories.
-func (d *DeployScanner) sync(dst, src string) {
+func (d *DeployScanner) sync(dst, src string) error {
 
 	jww.FEEDBACK.Println("Comparing Dst: ", dst, " With Src: ", src)
 
@@ -160,18 +214,16 @@ func (d *DeployScanner) sync(dst, src string) {
 	//We need an ordered set of filesnames too...
 	srcFileKeys := make([]string, 0)
 
-	var scan = func(path string, fileInfo os.FileInfo, inpErr error) (err error) {
+	var scan = func(path string, fileInfo os.FileInfo) error {
 		jww.TRACE.Println("Scanning: ", path)
-		if inpErr == nil {
-			srcFiles[path] = fileInfo
-			srcFileKeys = append(srcFileKeys, path)
-		}
+		srcFiles[path] = fileInfo
+		srcFileKeys = append(srcFileKeys, path)
 		return nil
 	}
 
-	err := filepath.Walk(src, scan)
-	check(err)
-	//jww.WARN.Println(srcFileKeys)
+	if err := d.walkSource(src, scan); err != nil {
+		return err
+	}
 
 	//For each source file entry
 	// If a directory
@@ -184,62 +236,11 @@ func (d *DeployScanner) sync(dst, src string) {
 	for _, srcFile := range srcFileKeys {
 		if d.shouldSkip(srcFile) {
 			jww.FEEDBACK.Println("Skipping ", srcFile)
-		} else {
-			//TODO: May be a bit of a naive approach to figure out path to destination file
-			dstFile := strings.Replace(srcFile, src, dst, 1)
-			sstat := srcFiles[srcFile]
-
-			jww.TRACE.Println("Checking source ", srcFile, " against destination ", dstFile)
-
-			dstat, err := os.Stat(dstFile)
-			if err != nil && !os.IsNotExist(err) {
-				panic(err)
-			}
-			dExists := (err == nil)
-
-			if sstat.IsDir() {
-				jww.TRACE.Println("Src is a directory: ", srcFile)
-				if dExists && dstat.IsDir() {
-					jww.TRACE.Println("Dst is a dir - nothing to do: ", dstFile)
-					jww.INFO.Println("Directories the same - skipping: ", dstFile)
-				}
-				if dExists && !dstat.IsDir() {
-					jww.TRACE.Println("Dst is a file: ", dstFile)
-					jww.INFO.Println("Replacing destination file with directory of same name: ", dstFile)
-					check(d.handleFunc(d.makeDeleteFileCmd(srcFile)))
-					check(d.handleFunc(d.makeCreateDirCmd(srcFile)))
-				}
-				if !dExists {
-					jww.TRACE.Println("Dst doesn't exist: ", dstFile)
-					jww.INFO.Println("Creating directory: ", dstFile)
-					check(d.handleFunc(d.makeCreateDirCmd(srcFile)))
-				}
-			} else {
-				jww.TRACE.Println("Src is a file: ", srcFile)
-				data, err := d.getSourceData(srcFile)
-				check(err)
-				if dExists && dstat.IsDir() {
-					jww.TRACE.Println("Dst is a dir: ", dstFile)
-					jww.INFO.Println("Replacing directory with file of same name: ", dstFile)
-					check(d.handleFunc(d.makeDeleteDirCmd(srcFile)))
-					check(d.handleFunc(d.makeCreateFileCmd(srcFile, data)))
-				}
-				if !dExists {
-					jww.TRACE.Println("Dst doesn't exist: ", dstFile)
-					jww.INFO.Println("Creating file: ", dstFile)
-					check(d.handleFunc(d.makeCreateFileCmd(srcFile, data)))
-				}
-				if dExists && !dstat.IsDir() {
-					jww.TRACE.Println("Dst is a file: ", dstFile)
-					if !d.filesEqual(srcFile, dstFile, data) {
-						jww.TRACE.Println("Dst exists - updating")
-						jww.INFO.Println("Updating file: ", dstFile)
-						check(d.handleFunc(d.makeUpdateFileCmd(srcFile, data)))
-					} else {
-						jww.INFO.Println("Files the same - skipping: ", dstFile)
-					}
-				}
-			}
+			d.compared(srcFile, COMPARE_SKIPPED)
+			continue
+		}
+		if err := d.syncEntry(dst, src, srcFile, srcFiles[srcFile]); err != nil {
+			return err
 		}
 	}
 
@@ -247,11 +248,27 @@ func (d *DeployScanner) sync(dst, src string) {
 	dstDeleteFiles := make([]string, 0)
 	dstDeleteDirs := make([]string, 0)
 	var scanDeletes = func(path string, fileInfo os.FileInfo, inpErr error) (err error) {
+		if err := d.ctx.Err(); err != nil {
+			return err
+		}
 		if inpErr == nil {
-			srcFileExpected := strings.Replace(path, dst, src, 1)
+			if path == filepath.Join(d.dstDir, LOCK_FILE) {
+				return nil
+			}
+			if fileInfo.IsDir() && containsPath(d.goneDirs, path) {
+				return filepath.SkipDir
+			}
+			srcFileExpected, err := rebase(path, dst, src)
+			if err != nil {
+				return err
+			}
 			jww.TRACE.Println("Checking to deleted: ", path, ". Looking for: ", srcFileExpected)
-			_, err := os.Stat(srcFileExpected)
-			if err != nil && os.IsNotExist(err) && !d.shouldSkip(path) {
+			_, err = lstat(d.srcFs, srcFileExpected)
+			if err == nil && isSymlink(fileInfo) && srcFiles[srcFileExpected] == nil && !d.shouldSkip(path) {
+				// A link deployed earlier whose source link is now skipped, broken or loops
+				dstDeleteFiles = append(dstDeleteFiles, srcFileExpected)
+			}
+			if err != nil && isNotExist(err) && !d.shouldSkip(path) {
 				if fileInfo.IsDir() {
 					dstDeleteDirs = append(dstDeleteDirs, srcFileExpected)
 				} else {
@@ -259,44 +276,228 @@ func (d *DeployScanner) sync(dst, src string) {
 
 				}
 			}
-			if err != nil && !os.IsNotExist(err) {
-				panic(err)
+			if err != nil && !isNotExist(err) {
+				return err
 			}
 		}
 		return nil
 	}
 
-	err = filepath.Walk(dst, scanDeletes)
-	check(err)
+	if err := d.record.walk(dst, scanDeletes); err != nil {
+		return err
+	}
 
 	for i := len(dstDeleteFiles) - 1; i >= 0; i-- {
 		if d.shouldSkip(dstDeleteFiles[i]) {
 			jww.FEEDBACK.Println("Skipping ", dstDeleteFiles[i])
+			continue
+		}
+		d.compared(dstDeleteFiles[i], COMPARE_DELETED)
+		if err := d.handle(d.makeDeleteFileCmd(dstDeleteFiles[i])); err != nil {
+			return err
 		}
-		check(d.handleFunc(d.makeDeleteFileCmd(dstDeleteFiles[i])))
 	}
 	for i := len(dstDeleteDirs) - 1; i >= 0; i-- {
 		if d.shouldSkip(dstDeleteDirs[i]) {
 			jww.FEEDBACK.Println("Skipping ", dstDeleteDirs[i])
+			continue
+		}
+		d.compared(dstDeleteDirs[i], COMPARE_DELETED)
+		if err := d.handle(d.makeDeleteDirCmd(dstDeleteDirs[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compared tells observers the outcome of comparing a source path
+func (d *DeployScanner) compared(src string, result CompareResult) {
+	d.observers.notify(&Event{Type: EVENT_FILE_COMPARED, RelPath: d.getRelativePath(src), Compare: result})
+}
+
+// syncEntry compares a single source file or directory with its destination
+// and generates the commands needed to bring the destination into line
+func (d *DeployScanner) syncEntry(dst, src, srcFile string, sstat os.FileInfo) error {
+	dstFile, err := rebase(srcFile, src, dst)
+	if err != nil {
+		return err
+	}
+
+	jww.TRACE.Println("Checking source ", srcFile, " against destination ", dstFile)
+
+	if !sstat.IsDir() && !isSymlink(sstat) && !d.checkFileBudget(srcFile, sstat) {
+		// Too big to even read
+		d.compared(srcFile, COMPARE_SKIPPED)
+		return nil
+	}
+
+	var dstat os.FileInfo
+	dExists := false
+	if !d.belowNewDir(dstFile) {
+		dstat, err = d.record.lstat(dstFile)
+		if err != nil && !isNotExist(err) {
+			return err
+		}
+		dExists = (err == nil)
+	}
+
+	if isSymlink(sstat) {
+		return d.syncLink(srcFile, dstFile, dstat, dExists)
+	}
+	if dExists && isSymlink(dstat) {
+		// A link previously deployed with symlinks: preserve. Remove it so it
+		// can be replaced with the real thing
+		jww.INFO.Println("Replacing link with the file or directory it pointed to: ", dstFile)
+		d.compared(srcFile, COMPARE_TYPE_CHANGED)
+		if err := d.handle(d.makeDeleteFileCmd(srcFile)); err != nil {
+			return err
+		}
+		if sstat.IsDir() {
+			// Anything the record has below dstFile is wherever the old link pointed
+			d.newDirs = append(d.newDirs, dstFile)
+			return d.handle(d.makeCreateDirCmd(srcFile))
+		}
+		data, err := d.getSourceData(srcFile)
+		if err != nil {
+			return err
+		}
+		return d.handle(d.makeCreateFileCmd(srcFile, data, sstat))
+	}
+
+	if sstat.IsDir() {
+		jww.TRACE.Println("Src is a directory: ", srcFile)
+		if dExists && dstat.IsDir() {
+			jww.TRACE.Println("Dst is a dir - nothing to do: ", dstFile)
+			jww.INFO.Println("Directories the same - skipping: ", dstFile)
+			d.compared(srcFile, COMPARE_SAME)
+		}
+		if dExists && !dstat.IsDir() {
+			jww.TRACE.Println("Dst is a file: ", dstFile)
+			jww.INFO.Println("Replacing destination file with directory of same name: ", dstFile)
+			d.compared(srcFile, COMPARE_TYPE_CHANGED)
+			if err := d.handle(d.makeDeleteFileCmd(srcFile)); err != nil {
+				return err
+			}
+			d.newDirs = append(d.newDirs, dstFile)
+			return d.handle(d.makeCreateDirCmd(srcFile))
+		}
+		if !dExists {
+			jww.TRACE.Println("Dst doesn't exist: ", dstFile)
+			jww.INFO.Println("Creating directory: ", dstFile)
+			d.compared(srcFile, COMPARE_NEW)
+			return d.handle(d.makeCreateDirCmd(srcFile))
+		}
+		return nil
+	}
+
+	jww.TRACE.Println("Src is a file: ", srcFile)
+	data, err := d.getSourceData(srcFile)
+	if err != nil {
+		return err
+	}
+	if dExists && dstat.IsDir() {
+		jww.TRACE.Println("Dst is a dir: ", dstFile)
+		jww.INFO.Println("Replacing directory with file of same name: ", dstFile)
+		d.compared(srcFile, COMPARE_TYPE_CHANGED)
+		if err := d.deleteDir(srcFile, dstFile); err != nil {
+			return err
+		}
+		return d.handle(d.makeCreateFileCmd(srcFile, data, sstat))
+	}
+	if !dExists {
+		jww.TRACE.Println("Dst doesn't exist: ", dstFile)
+		jww.INFO.Println("Creating file: ", dstFile)
+		d.compared(srcFile, COMPARE_NEW)
+		return d.handle(d.makeCreateFileCmd(srcFile, data, sstat))
+	}
+	jww.TRACE.Println("Dst is a file: ", dstFile)
+	equal, err := d.filesEqual(srcFile, dstFile, data)
+	if err != nil {
+		return err
+	}
+	if !equal {
+		jww.TRACE.Println("Dst exists - updating")
+		jww.INFO.Println("Updating file: ", dstFile)
+		d.compared(srcFile, COMPARE_CHANGED)
+		return d.handle(d.makeUpdateFileCmd(srcFile, data, sstat))
+	}
+	jww.INFO.Println("Files the same - skipping: ", dstFile)
+	d.compared(srcFile, COMPARE_SAME)
+	return nil
+}
+
+//belowNewDir reports whether dstFile is inside a directory this scan is
+//creating in place of a file or link, so can't have been deployed yet
+func (d *DeployScanner) belowNewDir(dstFile string) bool {
+	for _, dir := range d.newDirs {
+		if strings.HasPrefix(dstFile, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+//deleteDir deletes the deployed directory dstFile, the counterpart of
+//srcFile, to make way for a file or link. Its contents go first, deepest
+//first, as targets such as FTP servers only remove empty directories.
+func (d *DeployScanner) deleteDir(srcFile, dstFile string) error {
+	files := make([]string, 0)
+	dirs := make([]string, 0)
+	err := d.record.walk(dstFile, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dstFile {
+			return nil
+		}
+		srcPath, err := rebase(path, dstFile, srcFile)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, srcPath)
+		} else {
+			files = append(files, srcPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		d.compared(files[i], COMPARE_DELETED)
+		if err := d.handle(d.makeDeleteFileCmd(files[i])); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d.compared(dirs[i], COMPARE_DELETED)
+		if err := d.handle(d.makeDeleteDirCmd(dirs[i])); err != nil {
+			return err
 		}
-		check(d.handleFunc(d.makeDeleteDirCmd(dstDeleteDirs[i])))
 	}
+	d.goneDirs = append(d.goneDirs, dstFile)
+	return d.handle(d.makeDeleteDirCmd(srcFile))
 }
 
 func (d *DeployScanner) getSourceData(src string) ([]byte, error) {
-	contents, err := ioutil.ReadFile(src)
+	contents, err := afero.ReadFile(d.srcFs, src)
+	if err != nil {
+		return nil, err
+	}
 	jww.DEBUG.Println("getSourceData step 1: ", len(contents), " bytes read from: ", src)
-	check(err)
 	if d.minify {
 		mediatype := getMediaType(src)
 		jww.DEBUG.Println("Minifier media type ", mediatype, " for ", src)
 		if mediatype != "" {
 			contents, err = d.minifier.Bytes(mediatype, contents)
+			if err != nil {
+				return nil, fmt.Errorf("error minifying %s: %v", src, err)
+			}
 			jww.DEBUG.Println("getSourceData step 2: ", len(contents), " bytes when minified: ", src)
-			check(err)
 		}
 	}
-	return contents, err
+	return contents, nil
 }
 
 func getMediaType(path string) string {
@@ -311,35 +512,14 @@ func getMediaType(path string) string {
 	return ""
 }
 
-// equal returns true if both files are equal, but takes into account
-// that src may be minified.
-func (d *DeployScanner) filesEqual(src, dst string, srcdata []byte) bool {
-	// get file infos
-	info1, err1 := os.Stat(src)
-	info2, err2 := os.Stat(dst)
-	if os.IsNotExist(err1) || os.IsNotExist(err2) {
-		return false
-	}
-	check(err1)
-	check(err2)
-
-	// check sizes, but only if we aren't minifying as size will change
-	if !d.minify {
-		if info1.Size() != info2.Size() {
-			return false
-		}
-	}
-
-	// both have the same size, check the contents
-	// Hopefully the files aren't too big as there is no chunking...
-	contents, err := ioutil.ReadFile(dst)
-	check(err)
-
-	return bytes.Equal(contents, srcdata)
+// filesEqual returns true if dst in the deploy record holds srcdata, the
+// contents of src, minified if need be
+func (d *DeployScanner) filesEqual(src, dst string, srcdata []byte) (bool, error) {
+	return d.record.holds(dst, srcdata)
 }
 
-func checkDirExists(path, name string) error {
-	sstat, err := os.Stat(path)
+func checkDirExists(fs afero.Fs, path, name string) error {
+	sstat, err := fs.Stat(path)
 	if err != nil {
 		return err
 	}
@@ -351,9 +531,74 @@ func checkDirExists(path, name string) error {
 	return nil
 }
 
-func check(err error) {
+//isNotExist reports whether err means there is nothing at a path, including
+//because part of it is a file rather than a directory
+func isNotExist(err error) bool {
+	return os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)
+}
+
+//containsPath reports whether path is one of paths
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+//osFsIfNil defaults an unset filesystem to the operating system's
+func osFsIfNil(fs afero.Fs) afero.Fs {
+	if fs == nil {
+		return afero.NewOsFs()
+	}
+	return fs
+}
+
+//recordState is what the scanner knows of what has already been deployed:
+//either the deploy record directory or a Manifest. Paths are below the
+//scanner's dstDir.
+type recordState interface {
+	lstat(p string) (os.FileInfo, error)
+	readlink(p string) (string, error)
+	holds(p string, data []byte) (bool, error) //Whether the file p was deployed with data
+	walk(root string, walkFn filepath.WalkFunc) error
+}
+
+//fsRecord is a deploy record directory, holding a copy of each file as it
+//was sent
+type fsRecord struct {
+	fs afero.Fs
+}
+
+func (r fsRecord) lstat(p string) (os.FileInfo, error) {
+	return lstat(r.fs, p)
+}
+
+func (r fsRecord) readlink(p string) (string, error) {
+	return readlink(r.fs, p)
+}
+
+func (r fsRecord) holds(p string, data []byte) (bool, error) {
+	info, err := r.fs.Stat(p)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
 	if err != nil {
-		jww.ERROR.Println("Error: ", err)
-		panic(err)
+		return false, err
 	}
+	// The record holds what was sent, so after minifying too
+	if info.Size() != int64(len(data)) {
+		return false, nil
+	}
+	// Hopefully the files aren't too big as there is no chunking...
+	contents, err := afero.ReadFile(r.fs, p)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(contents, data), nil
+}
+
+func (r fsRecord) walk(root string, walkFn filepath.WalkFunc) error {
+	return afero.Walk(r.fs, root, walkFn)
 }
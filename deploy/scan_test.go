@@ -0,0 +1,80 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+//TestTypeChanges deploys a site, then the same site with a file replaced by
+//a directory and a directory by a file, checking the second deployment
+//brings the target into line. The operating system's filesystem is used as
+//that is what reports ENOTDIR when looking below a file.
+func TestTypeChanges(t *testing.T) {
+	osFs := afero.NewOsFs()
+	for _, remote := range []bool{false, true} {
+		name := "record"
+		if remote {
+			name = "manifest"
+		}
+		t.Run(name, func(t *testing.T) {
+			src, record, target := t.TempDir(), t.TempDir(), t.TempDir()
+			opts := Options{
+				SourceDir:      src,
+				RecordDir:      record,
+				Deployer:       &FileDeployer{TargetDir: target},
+				RemoteManifest: remote,
+			}
+
+			WriteTree(t, osFs, src, map[string]string{
+				"a/x.html":   "x",
+				"a/c/z.html": "z",
+				"b":          "b",
+				"same.html":  "same",
+			})
+			if err := Run(context.Background(), opts); err != nil {
+				t.Fatal("first deployment: ", err)
+			}
+
+			for _, p := range []string{"a", "b"} {
+				if err := os.RemoveAll(filepath.Join(src, p)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			WriteTree(t, osFs, src, map[string]string{
+				"a":        "a is a file now",
+				"b/y.html": "y",
+			})
+			if err := Run(context.Background(), opts); err != nil {
+				t.Fatal("second deployment: ", err)
+			}
+
+			want := map[string]string{
+				"a":         "a is a file now",
+				"b/y.html":  "y",
+				"same.html": "same",
+			}
+			CheckTree(t, osFs, target, want)
+			if !remote {
+				CheckTree(t, osFs, record, want)
+			}
+		})
+	}
+}
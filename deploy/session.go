@@ -0,0 +1,206 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+//Session keeps the deployment target connected across several deployments,
+//so repeated small pushes don't each pay for logging in again. The
+//connection is made by the first Deploy that has something to send, or by
+//the first Deploy with Options.RemoteManifest. The locks are held for the
+//life of the session, the remote one from when it first connects.
+type Session struct {
+	opts      Options
+	recorder  *FileDeployer
+	lock      *deployLock
+	connected bool
+}
+
+//NewSession checks opts, prepares the deploy record and takes the lock in
+//it. Close the session when done with it.
+func NewSession(opts Options) (*Session, error) {
+	if opts.Deployer == nil {
+		return nil, &Error{Op: OP_OPTIONS, Err: errors.New("no Deployer given")}
+	}
+	if opts.SourceDir == "" || (opts.RecordDir == "" && !opts.RemoteManifest) {
+		return nil, &Error{Op: OP_OPTIONS, Err: errors.New("SourceDir and RecordDir must both be set")}
+	}
+	s := &Session{opts: opts}
+	if !opts.RemoteManifest {
+		s.recorder = &FileDeployer{TargetDir: opts.RecordDir, Fs: opts.RecordFs}
+		if err := s.recorder.Initialise(); err != nil {
+			return nil, &Error{Op: OP_RECORD, Err: err}
+		}
+	}
+	s.lock = newDeployLock(opts)
+	if err := s.lock.lockLocal(); err != nil {
+		if s.recorder != nil {
+			s.recorder.Cleanup()
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+//Deploy works out what has changed in relDir, a directory below
+//opts.SourceDir, and applies it to opts.Deployer, updating the deploy record
+//or manifest as it goes. An empty relDir means all of it. If relDir no longer exists
+//in the source or the deploy record, the nearest directory above it that
+//does is deployed instead, so deletions are picked up. With
+//Options.RemoteManifest, the manifest is fetched afresh each time, as
+//another machine may have deployed since.
+func (s *Session) Deploy(ctx context.Context, relDir string) (err error) {
+	if err := s.lock.refresh(); err != nil {
+		return err
+	}
+
+	var manifest *Manifest
+	if s.opts.RemoteManifest {
+		if err := s.connect(); err != nil {
+			return err
+		}
+		if manifest, err = fetchManifest(s.opts); err != nil {
+			return err
+		}
+	}
+	relDir = s.existingDir(relDir, manifest)
+	plan, err := makePlan(ctx, s.opts, relDir, manifest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		plan.observers.notify(&Event{Type: EVENT_SUMMARY, Summary: plan.Summary(), Err: err})
+	}()
+	if err := budgetError(plan.Violations); err != nil {
+		return err
+	}
+	if len(plan.Commands) == 0 {
+		jww.FEEDBACK.Println("Nothing to deploy")
+		if manifest != nil && manifest.dirty {
+			return manifest.save(s.opts.Deployer, s.lock)
+		}
+		return nil
+	}
+	if s.opts.BeforeConnect != nil {
+		if err := s.opts.BeforeConnect(plan); err != nil {
+			return &Error{Op: OP_HOOK, Err: err}
+		}
+	}
+
+	if err := s.connect(); err != nil {
+		return err
+	}
+	var recorder Deployer = s.recorder
+	if manifest != nil {
+		recorder = manifest
+	}
+	err = plan.Apply(ctx, s.opts.Deployer, recorder)
+	if manifest != nil && manifest.dirty {
+		// Even after a failure, so what was sent isn't sent again
+		if serr := manifest.save(s.opts.Deployer, s.lock); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	if err != nil {
+		if e, ok := err.(*Error); ok && e.Op == OP_APPLY {
+			// The connection may have dropped. Start afresh next time
+			s.lock.unlockRemote()
+			s.disconnect()
+		}
+		return err
+	}
+	if s.opts.AfterApply != nil {
+		if err := s.opts.AfterApply(plan); err != nil {
+			return &Error{Op: OP_CHECK, Err: err}
+		}
+	}
+	return nil
+}
+
+//connect connects to the deployment target, if not already connected, and
+//takes the remote lock if it isn't already held
+func (s *Session) connect() error {
+	if !s.connected {
+		if err := s.opts.Deployer.Initialise(); err != nil {
+			return &Error{Op: OP_CONNECT, Err: err}
+		}
+		s.connected = true
+	}
+	return s.lock.lockRemote(s.opts.Deployer)
+}
+
+//KeepAlive stops an idle connection being closed by the server, where the
+//Deployer can ping it. If the ping fails, the connection is dropped and made
+//again by the next Deploy.
+func (s *Session) KeepAlive() {
+	if !s.connected {
+		return
+	}
+	if p, ok := s.opts.Deployer.(Prober); ok {
+		if err := p.Ping(); err != nil {
+			jww.WARN.Println("Lost connection to ", s.opts.Deployer.GetName(), ": ", err, " - will reconnect when needed")
+			s.disconnect()
+		}
+	}
+}
+
+func (s *Session) disconnect() {
+	// Taken again on reconnecting. If the lock file is still there, it's ours
+	s.lock.remote = nil
+	if err := s.opts.Deployer.Cleanup(); err != nil {
+		jww.DEBUG.Println("Error closing connection: ", err)
+	}
+	s.connected = false
+}
+
+//Close releases the locks and disconnects from the deployment target
+func (s *Session) Close() error {
+	if s.recorder != nil {
+		defer s.recorder.Cleanup()
+	}
+	defer s.lock.unlockLocal()
+	if !s.connected {
+		return nil
+	}
+	s.lock.unlockRemote()
+	s.connected = false
+	if err := s.opts.Deployer.Cleanup(); err != nil {
+		return &Error{Op: OP_CLEANUP, Err: err}
+	}
+	return nil
+}
+
+//existingDir climbs from relDir towards the root until it finds a directory
+//that exists in both the source and the deploy record, or manifest if given
+func (s *Session) existingDir(relDir string, manifest *Manifest) string {
+	record, recordDir := recordFor(s.opts, manifest)
+	relDir = filepath.Clean(relDir)
+	for relDir != "." && relDir != "" && !strings.HasPrefix(relDir, "..") {
+		if checkDirExists(osFsIfNil(s.opts.SourceFs), filepath.Join(s.opts.SourceDir, relDir), "Source") == nil {
+			if info, err := record.lstat(filepath.Join(recordDir, relDir)); err == nil && info.IsDir() {
+				return relDir
+			}
+		}
+		relDir = filepath.Dir(relDir)
+	}
+	return ""
+}
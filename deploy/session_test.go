@@ -0,0 +1,115 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+//lockCounter counts the writes of the lock file on the target
+type lockCounter struct {
+	*FileDeployer
+	writes int
+}
+
+func (c *lockCounter) ApplyCommand(cmd *DeployCommand) error {
+	if strings.HasSuffix(cmd.RelPath, LOCK_FILE) && cmd.Command != COMMAND_FILE_DEL {
+		c.writes++
+	}
+	return c.FileDeployer.ApplyCommand(cmd)
+}
+
+//TestSessionLocks deploys twice in one session with a remote lock, checking
+//the locks are taken once and held between deployments, then released by
+//Close
+func TestSessionLocks(t *testing.T) {
+	osFs := afero.NewOsFs()
+	src, record, target := t.TempDir(), t.TempDir(), t.TempDir()
+	deployer := &lockCounter{FileDeployer: &FileDeployer{TargetDir: target}}
+	s, err := NewSession(Options{SourceDir: src, RecordDir: record, Deployer: deployer, RemoteLock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	localLock, remoteLock := filepath.Join(record, LOCK_FILE), filepath.Join(target, LOCK_FILE)
+
+	start := time.Now()
+	for i, page := range []string{"one.html", "two.html"} {
+		WriteTree(t, osFs, src, map[string]string{page: page})
+		if err := s.Deploy(context.Background(), ""); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []string{localLock, remoteLock} {
+			if _, err := os.Stat(p); err != nil {
+				t.Errorf("after deployment %d: %v", i+1, err)
+			}
+		}
+	}
+	if deployer.writes != 1 {
+		t.Errorf("remote lock written %d times, want 1", deployer.writes)
+	}
+	if d := time.Since(start); d >= 2*remoteLockSettle {
+		t.Errorf("two deployments took %v - waiting for the remote lock each time?", d)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{localLock, remoteLock} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left after Close: %v", p, err)
+		}
+	}
+	CheckTree(t, osFs, target, map[string]string{"one.html": "one.html", "two.html": "two.html"})
+}
+
+//TestLockRefresh checks locks half way to going stale are brought up to
+//date, so a long session keeps them
+func TestLockRefresh(t *testing.T) {
+	record, target := t.TempDir(), t.TempDir()
+	deployer := &FileDeployer{TargetDir: target}
+	if err := deployer.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	lock := newDeployLock(Options{RecordDir: record, RemoteLock: true, StaleLockAge: time.Hour})
+	if err := lock.lockLocal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.lockRemote(deployer); err != nil {
+		t.Fatal(err)
+	}
+	lock.info.Start = time.Now().Add(-31 * time.Minute)
+	if err := lock.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{record, target} {
+		held, err := readLocalLock(afero.NewOsFs(), filepath.Join(dir, LOCK_FILE))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if held.Token != lock.info.Token || time.Since(held.Start) > time.Minute {
+			t.Errorf("%s: lock not refreshed: %v", dir, held)
+		}
+	}
+	if lock.remote == nil {
+		t.Error("remote lock dropped")
+	}
+}
@@ -15,22 +15,36 @@
 package deploy
 
 import (
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/pkg/sftp"
 	jww "github.com/spf13/jwalterweatherman"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
-/* NOTE: INCOMPLETE, UNTESTED CODE */
+//SFTP_DEFAULT_PORT is used when no port is configured
+const SFTP_DEFAULT_PORT = "22"
 
 type SFTPDeployer struct {
-	HostID     string
-	Port       string
-	UID        string
-	PWD        string
-	sshClient  *ssh.Client
-	sftpClient *sftp.Client
+	HostID      string
+	Port        string
+	UID         string
+	PWD         string
+	RootDir     string
+	sshClient   *ssh.Client
+	sftpClient  *sftp.Client
+	checksumCmd int //Index into sftpChecksumCmds of the first one worth trying
 }
 
 func (s *SFTPDeployer) GetName() string {
@@ -40,31 +54,43 @@ func (s *SFTPDeployer) GetName() string {
 func (s *SFTPDeployer) Initialise() error {
 	serr := ""
 	jww.INFO.Println("Getting SFTP settings")
-	// Gather together settings
-	s.HostID = viper.GetString("sftp.host")
-	s.Port = viper.GetString("sftp.port")
-	s.UID = viper.GetString("sftp.user")
-	s.PWD = viper.GetString("sftp.pwd")
-	jww.INFO.Println("Got SFTP settings: ", s.HostID, s.Port, s.UID)
+	// Gather together settings. Anything already set takes precedence
+	setFromConfig(&s.HostID, "sftp.host")
+	setFromConfig(&s.Port, "sftp.port")
+	setFromConfig(&s.UID, "sftp.user")
+	setFromConfig(&s.RootDir, "sftp.rootdir")
+	setUserFromNetrc(&s.UID, s.HostID)
+	if s.Port == "" {
+		s.Port = SFTP_DEFAULT_PORT
+	}
+	jww.INFO.Println("Got SFTP settings: ", s.HostID, s.Port, s.UID, s.RootDir)
 
 	if s.HostID == "" {
 		serr = serr + "HostID not found. Define sftp.host in config file. "
 	}
-	if s.Port == "" {
-		serr = serr + "Port not found. Define sftp.port in config file. "
-	}
 	if s.UID == "" {
-		serr = serr + "UID not found. Define sftp.user in config file. "
+		serr = serr + "UID not found. Define sftp.user in config file or a login in ~/.netrc. "
+	}
+	if s.RootDir == "" {
+		s.RootDir = "/"
+		jww.WARN.Println("SFTP: Website root directory not found (sftp: rootdir in config). Defaulting to '/'")
 	}
-	if s.PWD == "" {
-		serr = serr + "PWD not found. Define sftp.pwd in config file. "
+	RegisterSecret(s.PWD)
+	if serr == "" && s.PWD == "" {
+		var perr error
+		if s.PWD, perr = ResolvePassword("sftp", s.HostID, s.UID); perr != nil {
+			serr = serr + perr.Error() + ". "
+		}
 	}
 
 	if serr != "" {
 		return errors.New("Error initialising SFTP Deployer. " + serr)
 	}
 
-	err := errors.New("") //Must be away to avoid this, but double function returns below barf
+	hostKeyCallback, err := sftpHostKeyCallback()
+	if err != nil {
+		return err
+	}
 
 	//Attempt to connect. First create the SSH client:
 	config := &ssh.ClientConfig{
@@ -72,11 +98,12 @@ func (s *SFTPDeployer) Initialise() error {
 		Auth: []ssh.AuthMethod{
 			ssh.Password(s.PWD),
 		},
+		HostKeyCallback: hostKeyCallback,
 	}
 	s.sshClient, err = ssh.Dial("tcp", s.HostID+":"+s.Port, config)
 	if err != nil {
 		jww.ERROR.Println("SSH subsystem failed to connect to ", s.HostID, " Error: ", err)
-		return err
+		return fmt.Errorf("SSH connect failed: %v", err)
 	}
 	jww.INFO.Println("Successfully connected to SSH")
 
@@ -84,22 +111,275 @@ func (s *SFTPDeployer) Initialise() error {
 	s.sftpClient, err = sftp.NewClient(s.sshClient)
 	if err != nil {
 		jww.ERROR.Println("SFTP failed to connect. Error: ", err)
-		return err
+		s.sshClient.Close()
+		return fmt.Errorf("SFTP subsystem failed: %v", err)
 	}
-	jww.INFO.Println("Successfully connected to SFTP")
+	jww.FEEDBACK.Println("Successfully connected to SFTP")
 
 	return nil
 
 }
 
+//sftpHostKeyCallback verifies the server against ~/.ssh/known_hosts (or the
+//file named by sftp.knownhosts). Host key checking can be switched off with
+//sftp.insecureignorehostkey, but only for troubleshooting.
+func sftpHostKeyCallback() (ssh.HostKeyCallback, error) {
+	if viper.GetBool("sftp.insecureignorehostkey") {
+		jww.WARN.Println("SFTP host key checking disabled - the server's identity is not being verified")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	file := viper.GetString("sftp.knownhosts")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("can't find home directory for known_hosts: %v", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	cb, err := knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SSH known hosts file %s: %v. Connect once with ssh to add the server, or set sftp.knownhosts", file, err)
+	}
+	return cb, nil
+}
+
 func (s *SFTPDeployer) ApplyCommand(cmd *DeployCommand) error {
-	return errors.New("SFTP Cms not implemented yet")
+	p := path.Join(s.RootDir, filepath.ToSlash(cmd.RelPath))
+
+	switch cmd.Command {
+	case COMMAND_FILE_ADD, COMMAND_FILE_UPD:
+		if err := s.UploadFile(p, cmd.Contents); err != nil {
+			return err
+		}
+		return s.SetAttributes(p, cmd.Mode, cmd.ModTime)
+
+	case COMMAND_DIR_ADD:
+		if err := s.MakeDirectory(p); err != nil {
+			return err
+		}
+		return s.SetAttributes(p, cmd.Mode, time.Time{})
+
+	case COMMAND_DIR_DEL:
+		return s.RemoveDirectory(p)
+
+	case COMMAND_FILE_DEL:
+		return s.RemoveFile(p)
+
+	case COMMAND_LINK_ADD:
+		return s.MakeLink(p, cmd.LinkTarget)
+
+	default:
+		return errors.New("Not implemented")
+	}
 }
 
-func (s *SFTPDeployer) Cleanup() error {
+func (s *SFTPDeployer) UploadFile(path string, data []byte) error {
+	jww.FEEDBACK.Println("Sending file: ", path, "...")
+	jww.DEBUG.Println("Data Size: ", len(data))
+
+	f, err := s.sftpClient.Create(path)
+	if err != nil {
+		jww.ERROR.Println("SFTP Error creating file: ", path, err)
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		jww.ERROR.Println("SFTP Error uploading file: ", path, err)
+		return err
+	}
+	jww.INFO.Println("Successfully SFTP'd file: ", path)
+	return nil
+}
+
+func (s *SFTPDeployer) RemoveDirectory(path string) error {
+	jww.FEEDBACK.Println("Deleting directory: ", path, "...")
+	if err := s.sftpClient.RemoveAll(path); err != nil {
+		if os.IsNotExist(err) {
+			jww.INFO.Println("Looks like SFTP directory already deleted: ", path)
+			return nil
+		}
+		jww.ERROR.Println("SFTP Error deleting directory: ", path, err)
+		return err
+	}
+	jww.INFO.Println("Successfully deleted directory: ", path)
+	return nil
+}
+
+func (s *SFTPDeployer) RemoveFile(path string) error {
+	jww.FEEDBACK.Println("Deleting file: ", path, "...")
+	if err := s.sftpClient.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			jww.INFO.Println("Looks like SFTP file already deleted: ", path)
+			return nil
+		}
+		jww.ERROR.Println("SFTP Error deleting file: ", path, err)
+		return err
+	}
+	jww.INFO.Println("Successfully deleted file: ", path)
+	return nil
+}
+
+func (s *SFTPDeployer) MakeDirectory(path string) error {
+	jww.FEEDBACK.Println("Creating directory: ", path, "...")
+	if err := s.sftpClient.Mkdir(path); err != nil {
+		if fi, serr := s.sftpClient.Stat(path); serr == nil && fi.IsDir() {
+			jww.INFO.Println("Looks like SFTP directory already exists: ", path)
+			return nil
+		}
+		jww.ERROR.Println("SFTP Error creating directory: ", path, err)
+		return err
+	}
+	jww.INFO.Println("Successfully created SFTP directory: ", path)
+	return nil
+}
+
+//MakeLink creates a symbolic link at path pointing to target, replacing
+//whatever file or link is already there
+func (s *SFTPDeployer) MakeLink(path string, target string) error {
+	jww.FEEDBACK.Println("Creating link: ", path, " -> ", target, "...")
+	if err := s.sftpClient.Remove(path); err != nil && !os.IsNotExist(err) {
+		jww.ERROR.Println("SFTP Error replacing with link: ", path, err)
+		return err
+	}
+	if err := s.sftpClient.Symlink(target, path); err != nil {
+		jww.ERROR.Println("SFTP Error creating link: ", path, err)
+		return err
+	}
+	jww.INFO.Println("Successfully created SFTP link: ", path)
+	return nil
+}
+
+//SetAttributes sets the permissions and modification time of path where they
+//are given
+func (s *SFTPDeployer) SetAttributes(path string, mode os.FileMode, mtime time.Time) error {
+	if mode != 0 {
+		if err := s.sftpClient.Chmod(path, mode); err != nil {
+			jww.ERROR.Println("SFTP Error setting permissions: ", path, err)
+			return err
+		}
+		jww.INFO.Println("Set permissions of ", path, " to ", fmt.Sprintf("%04o", mode))
+	}
+	if !mtime.IsZero() {
+		if err := s.sftpClient.Chtimes(path, mtime, mtime); err != nil {
+			jww.ERROR.Println("SFTP Error setting modification time: ", path, err)
+			return err
+		}
+	}
+	return nil
+}
+
+//List describes the contents of relDir on the server
+func (s *SFTPDeployer) List(relDir string) ([]RemoteFile, error) {
+	infos, err := s.sftpClient.ReadDir(path.Join(s.RootDir, filepath.ToSlash(relDir)))
+	if err != nil {
+		return nil, err
+	}
+	files := make([]RemoteFile, 0, len(infos))
+	for _, fi := range infos {
+		files = append(files, RemoteFile{Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()})
+	}
+	return files, nil
+}
+
+//Size gives the size of relPath on the server
+func (s *SFTPDeployer) Size(relPath string) (int64, error) {
+	fi, err := s.sftpClient.Stat(path.Join(s.RootDir, filepath.ToSlash(relPath)))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+//Download fetches relPath from the server
+func (s *SFTPDeployer) Download(relPath string) ([]byte, error) {
+	f, err := s.sftpClient.Open(path.Join(s.RootDir, filepath.ToSlash(relPath)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+//sftpChecksumCmds are tried in turn until one is found on the server.
+//sha256sum is in GNU coreutils; shasum comes with perl on BSDs and macOS.
+var sftpChecksumCmds = []string{"sha256sum --", "shasum -a 256 --"}
+
+//Checksum runs a SHA-256 checksum command on the server over SSH. This needs
+//shell access as well as SFTP, which many hosts don't allow: exec is refused,
+//the command fails or gives nothing useful. Any of those means checksums
+//are unsupported, and they aren't tried again for later files.
+func (s *SFTPDeployer) Checksum(relPath string) (string, string, error) {
+	p := path.Join(s.RootDir, filepath.ToSlash(relPath))
+	for i := s.checksumCmd; i < len(sftpChecksumCmds); i++ {
+		session, err := s.sshClient.NewSession()
+		if err != nil {
+			jww.INFO.Println("SFTP checksums unavailable - can't open an SSH session: ", err)
+			break
+		}
+		out, err := session.Output(sftpChecksumCmds[i] + " " + shellQuote(p))
+		session.Close()
+		if exit, ok := err.(*ssh.ExitError); ok && exit.ExitStatus() == 127 {
+			// Command not found
+			s.checksumCmd = i + 1
+			continue
+		}
+		if err != nil {
+			jww.INFO.Println("SFTP checksums unavailable - ", sftpChecksumCmds[i], " failed: ", err)
+			break
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) == 0 || !isSHA256(fields[0]) {
+			jww.INFO.Println("SFTP checksums unavailable - ", sftpChecksumCmds[i], " gave ", strconv.Quote(string(out)))
+			break
+		}
+		return HASH_SHA256, strings.ToLower(fields[0]), nil
+	}
+	s.checksumCmd = len(sftpChecksumCmds)
+	return "", "", ErrChecksumUnsupported
+}
+
+//isSHA256 checks s looks like a hex SHA-256 checksum
+func isSHA256(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+//shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
 
-	s.sftpClient.Close()
-	s.sshClient.Close()
+//Ping does a round trip to the server without changing anything
+func (s *SFTPDeployer) Ping() error {
+	_, err := s.sftpClient.Getwd()
+	return err
+}
+
+//CheckRoot confirms the website root directory exists on the server
+func (s *SFTPDeployer) CheckRoot() error {
+	fi, err := s.sftpClient.Stat(s.RootDir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.RootDir)
+	}
+	return nil
+}
+
+func (s *SFTPDeployer) Cleanup() error {
+	if s.sftpClient != nil {
+		s.sftpClient.Close()
+	}
+	if s.sshClient != nil {
+		s.sshClient.Close()
+	}
 
 	return nil
 }
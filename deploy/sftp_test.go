@@ -0,0 +1,182 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testSHA256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+//execHandler answers an exec request for command on a session channel
+type execHandler func(ch ssh.Channel, req *ssh.Request, command string)
+
+//TestSFTPChecksum runs SFTPDeployer.Checksum against SSH servers that do and
+//don't let it run a checksum command. Where it can't, checksums must be
+//reported as unsupported, so verification falls back to downloading, and
+//not tried again for the next file.
+func TestSFTPChecksum(t *testing.T) {
+	cases := []struct {
+		name  string
+		exec  execHandler
+		sum   string //Empty if checksums are unsupported
+		execs int    //Exec requests made by two calls
+	}{
+		{"sha256sum", func(ch ssh.Channel, req *ssh.Request, command string) {
+			req.Reply(true, nil)
+			ch.Write([]byte(testSHA256 + "  /www/index.html\n"))
+			exitStatus(ch, 0)
+		}, testSHA256, 2},
+		{"shasum only", func(ch ssh.Channel, req *ssh.Request, command string) {
+			req.Reply(true, nil)
+			if strings.HasPrefix(command, "sha256sum") {
+				exitStatus(ch, 127)
+				return
+			}
+			ch.Write([]byte(testSHA256 + "  /www/index.html\n"))
+			exitStatus(ch, 0)
+		}, testSHA256, 3},
+		{"no checksum commands", func(ch ssh.Channel, req *ssh.Request, command string) {
+			req.Reply(true, nil)
+			exitStatus(ch, 127)
+		}, "", 2},
+		{"exec refused", func(ch ssh.Channel, req *ssh.Request, command string) {
+			req.Reply(false, nil)
+		}, "", 1},
+		{"sftp only", func(ch ssh.Channel, req *ssh.Request, command string) {
+			req.Reply(true, nil)
+			ch.Stderr().Write([]byte("This service allows sftp connections only.\n"))
+			exitStatus(ch, 1)
+		}, "", 1},
+		{"no exit status", func(ch ssh.Channel, req *ssh.Request, command string) {
+			req.Reply(true, nil)
+		}, "", 1},
+		{"no output", func(ch ssh.Channel, req *ssh.Request, command string) {
+			req.Reply(true, nil)
+			exitStatus(ch, 0)
+		}, "", 1},
+		{"not a checksum", func(ch ssh.Channel, req *ssh.Request, command string) {
+			req.Reply(true, nil)
+			ch.Write([]byte("Welcome to our hosting!\n"))
+			exitStatus(ch, 0)
+		}, "", 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, execs := newTestSSHServer(t, c.exec)
+			s := &SFTPDeployer{RootDir: "/www", sshClient: client}
+			for i := 0; i < 2; i++ {
+				algorithm, sum, err := s.Checksum("index.html")
+				if c.sum == "" {
+					if err != ErrChecksumUnsupported {
+						t.Fatalf("got %q, %v, want ErrChecksumUnsupported", sum, err)
+					}
+					continue
+				}
+				if err != nil || algorithm != HASH_SHA256 || sum != c.sum {
+					t.Fatalf("got %s %q, %v, want %s %q", algorithm, sum, err, HASH_SHA256, c.sum)
+				}
+			}
+			if n := execs(); n != c.execs {
+				t.Errorf("%d exec requests, want %d", n, c.execs)
+			}
+		})
+	}
+}
+
+//exitStatus ends an exec request with status
+func exitStatus(ch ssh.Channel, status uint32) {
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+//newTestSSHServer starts an SSH server that accepts anyone and passes exec
+//requests to exec, returning a client connected to it and a count of the
+//exec requests so far
+func newTestSSHServer(t *testing.T, exec execHandler) (*ssh.Client, func() int) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	execs := 0
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		for newCh := range chans {
+			if newCh.ChannelType() != "session" {
+				newCh.Reject(ssh.UnknownChannelType, "session only")
+				continue
+			}
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer ch.Close()
+				for req := range chReqs {
+					if req.Type != "exec" {
+						req.Reply(false, nil)
+						continue
+					}
+					mu.Lock()
+					execs++
+					mu.Unlock()
+					var payload struct{ Command string }
+					ssh.Unmarshal(req.Payload, &payload)
+					exec(ch, req, payload.Command)
+					return
+				}
+			}()
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return execs
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/afero"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+//How symbolic links in the source directory are handled
+const (
+	SYMLINKS_FOLLOW   = "follow"   //Deploy what the link points to, as if it were there
+	SYMLINKS_SKIP     = "skip"     //Ignore links altogether
+	SYMLINKS_PRESERVE = "preserve" //Create the same link on the target
+)
+
+//SymlinkPolicies lists the valid values for Options.Symlinks
+var SymlinkPolicies = []string{SYMLINKS_FOLLOW, SYMLINKS_SKIP, SYMLINKS_PRESERVE}
+
+//CheckSymlinkPolicy returns an error for an unknown symlink policy
+func CheckSymlinkPolicy(policy string) error {
+	for _, p := range SymlinkPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown symlinks policy %q. Valid policies are: %v", policy, SymlinkPolicies)
+}
+
+//lstat is Stat without following a final symbolic link, where fs supports links
+func lstat(fs afero.Fs, p string) (os.FileInfo, error) {
+	if l, ok := fs.(afero.Lstater); ok {
+		fi, _, err := l.LstatIfPossible(p)
+		return fi, err
+	}
+	return fs.Stat(p)
+}
+
+func isSymlink(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeSymlink != 0
+}
+
+func readlink(fs afero.Fs, p string) (string, error) {
+	if r, ok := fs.(afero.LinkReader); ok {
+		return r.ReadlinkIfPossible(p)
+	}
+	return "", errors.New("filesystem doesn't support symbolic links")
+}
+
+//realPath resolves any links in p so the same directory reached by different
+//routes can be recognised. Only the OS filesystem has links to resolve.
+func realPath(fs afero.Fs, p string) string {
+	if _, ok := fs.(*afero.OsFs); ok {
+		if r, err := filepath.EvalSymlinks(p); err == nil {
+			if abs, err := filepath.Abs(r); err == nil {
+				return abs
+			}
+			return r
+		}
+	}
+	return p
+}
+
+//walkSource visits root and everything below it in lexical order, like
+//filepath.Walk, applying the symlink policy. With SYMLINKS_FOLLOW, fn is
+//given the FileInfo of what the link points to; with SYMLINKS_PRESERVE, that
+//of the link itself.
+func (d *DeployScanner) walkSource(root string, fn func(path string, info os.FileInfo) error) error {
+	info, err := lstat(d.srcFs, root)
+	if err != nil {
+		return err
+	}
+	return d.walkEntry(root, info, nil, fn)
+}
+
+//walkEntry visits p and, if it is a directory, its contents. parents are the
+//real paths of the directories above p, to catch links that loop back.
+func (d *DeployScanner) walkEntry(p string, info os.FileInfo, parents []string, fn func(path string, info os.FileInfo) error) error {
+	if err := d.ctx.Err(); err != nil {
+		return err
+	}
+	if isSymlink(info) {
+		switch d.symlinks {
+		case SYMLINKS_SKIP:
+			jww.INFO.Println("Skipping symbolic link: ", p)
+			d.compared(p, COMPARE_SKIPPED)
+			return nil
+		case SYMLINKS_PRESERVE:
+			return fn(p, info)
+		default:
+			target, err := d.srcFs.Stat(p)
+			if err != nil {
+				jww.WARN.Println("Skipping broken symbolic link ", p, ": ", err)
+				d.compared(p, COMPARE_SKIPPED)
+				return nil
+			}
+			info = target
+		}
+	}
+
+	real := ""
+	if info.IsDir() {
+		real = realPath(d.srcFs, p)
+		for _, parent := range parents {
+			if parent == real {
+				jww.WARN.Println("Skipping symbolic link ", p, " - it loops back to ", real)
+				d.compared(p, COMPARE_SKIPPED)
+				return nil
+			}
+		}
+	}
+
+	if err := fn(p, info); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+
+	names, err := readDirNames(d.srcFs, p)
+	if err != nil {
+		return err
+	}
+	parents = append(parents, real)
+	for _, name := range names {
+		child := filepath.Join(p, name)
+		ci, err := lstat(d.srcFs, child)
+		if err != nil {
+			return err
+		}
+		if err := d.walkEntry(child, ci, parents, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDirNames(fs afero.Fs, dir string) ([]string, error) {
+	f, err := fs.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//syncLink brings the destination into line with a source link, when links
+//are being preserved
+func (d *DeployScanner) syncLink(srcFile, dstFile string, dstat os.FileInfo, dExists bool) error {
+	target, err := readlink(d.srcFs, srcFile)
+	if err != nil {
+		return err
+	}
+	if filepath.IsAbs(target) {
+		jww.WARN.Println("Symbolic link ", srcFile, " points to absolute path ", target, " - it may not exist on the server")
+	}
+
+	switch {
+	case !dExists:
+		jww.INFO.Println("Creating link: ", dstFile, " -> ", target)
+		d.compared(srcFile, COMPARE_NEW)
+	case isSymlink(dstat):
+		old, err := d.record.readlink(dstFile)
+		if err != nil {
+			return err
+		}
+		if old == target {
+			jww.INFO.Println("Links the same - skipping: ", dstFile)
+			d.compared(srcFile, COMPARE_SAME)
+			return nil
+		}
+		jww.INFO.Println("Updating link: ", dstFile, " -> ", target)
+		d.compared(srcFile, COMPARE_CHANGED)
+	case dstat.IsDir():
+		jww.INFO.Println("Replacing directory with link of same name: ", dstFile)
+		d.compared(srcFile, COMPARE_TYPE_CHANGED)
+		if err := d.deleteDir(srcFile, dstFile); err != nil {
+			return err
+		}
+	default:
+		jww.INFO.Println("Replacing file with link of same name: ", dstFile)
+		d.compared(srcFile, COMPARE_TYPE_CHANGED)
+	}
+	return d.handle(d.makeCreateLinkCmd(srcFile, target))
+}
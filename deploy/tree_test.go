@@ -0,0 +1,79 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+//Fixture helpers shared by the tests in package deploy and deploy_test.
+//They are exported so the deploy_test tests, which need ftptest and so
+//can't be in package deploy, can use them too.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+//WriteTree creates each file in files, a slash separated path below dir on
+//fs mapped to its contents, with its parent directories
+func WriteTree(t *testing.T, fs afero.Fs, dir string, files map[string]string) {
+	t.Helper()
+	for p, contents := range files {
+		p = filepath.Join(dir, filepath.FromSlash(p))
+		if err := fs.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := afero.WriteFile(fs, p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//CheckTree checks dir on fs holds exactly the files in want, ignoring the
+//lock and manifest files
+func CheckTree(t *testing.T, fs afero.Fs, dir string, want map[string]string) {
+	t.Helper()
+	got := make(map[string]string)
+	err := afero.Walk(fs, dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == MANIFEST_FILE || strings.HasPrefix(rel, LOCK_FILE) {
+			return nil
+		}
+		data, err := afero.ReadFile(fs, p)
+		got[rel] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, contents := range want {
+		if got[p] != contents {
+			t.Errorf("%s: got %q, want %q", p, got[p], contents)
+		}
+	}
+	for p := range got {
+		if _, ok := want[p]; !ok {
+			t.Errorf("%s: left in %s", p, dir)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//PublicURL gives the address relPath is served from, for a site whose root
+//is at baseURL, e.g. https://example.com/blog/
+func PublicURL(baseURL, relPath string) (string, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid baseURL %q: %v", baseURL, err)
+	}
+	if !base.IsAbs() || base.Host == "" {
+		return "", fmt.Errorf("baseURL %q should be a full address such as https://example.com/", baseURL)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	rel := strings.TrimPrefix(filepath.ToSlash(relPath), "/")
+	return base.ResolveReference(&url.URL{Path: rel}).String(), nil
+}
+
+//ChangedURLs lists, sorted and without duplicates, the public URLs of the
+//files added, updated or deleted by cmds, e.g. for purging from a CDN cache.
+//An index.html file is listed under its directory's URL as well as its own.
+func ChangedURLs(baseURL string, cmds []*DeployCommand) ([]string, error) {
+	if baseURL == "" {
+		return nil, errors.New("baseURL is needed to work out the changed URLs")
+	}
+	seen := make(map[string]bool)
+	for _, cmd := range cmds {
+		if !cmd.IsFileCommand() && cmd.Command != COMMAND_FILE_DEL && cmd.Command != COMMAND_LINK_ADD {
+			continue
+		}
+		rel := filepath.ToSlash(cmd.RelPath)
+		paths := []string{rel}
+		if path.Base(rel) == "index.html" {
+			paths = append(paths, strings.TrimSuffix(rel, "index.html"))
+		}
+		for _, p := range paths {
+			u, err := PublicURL(baseURL, p)
+			if err != nil {
+				return nil, err
+			}
+			seen[u] = true
+		}
+	}
+	urls := make([]string, 0, len(seen))
+	for u := range seen {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
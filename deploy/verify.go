@@ -0,0 +1,103 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"bytes"
+	"fmt"
+
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+//Sizer is implemented by Deployers that can report the size of a file on the
+//target. relPath is relative to the website root.
+type Sizer interface {
+	Size(relPath string) (int64, error)
+}
+
+//Downloader is implemented by Deployers that can fetch a file back from the
+//target. relPath is relative to the website root.
+type Downloader interface {
+	Download(relPath string) ([]byte, error)
+}
+
+//VerifyDownloadMax is the largest file that is downloaded again to verify an
+//upload when the target can't provide a checksum
+const VerifyDownloadMax = 256 * 1024
+
+//VerifyError reports an upload that doesn't match what was sent
+type VerifyError struct {
+	RelPath string
+	Reason  string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("verification of %s failed: %s", e.RelPath, e.Reason)
+}
+
+//verifyUpload checks that the file cmd sent to target arrived intact. The size
+//is checked first, then a checksum if the target supports them, otherwise
+//small files are downloaded and compared. Targets that can do none of these
+//pass with a warning. A *VerifyError is returned for a mismatch, any other
+//error means verification couldn't be done.
+func verifyUpload(target Deployer, cmd *DeployCommand) error {
+	checked := false
+
+	if s, ok := target.(Sizer); ok {
+		n, err := s.Size(cmd.RelPath)
+		if err != nil {
+			return err
+		}
+		if n != int64(len(cmd.Contents)) {
+			return &VerifyError{cmd.RelPath, fmt.Sprintf("%d bytes on target, %d bytes sent", n, len(cmd.Contents))}
+		}
+		checked = true
+	}
+
+	if c, ok := target.(Checksummer); ok {
+		algorithm, sum, err := c.Checksum(cmd.RelPath)
+		if err == nil {
+			want, err := HashData(algorithm, cmd.Contents)
+			if err != nil {
+				return err
+			}
+			if sum != want {
+				return &VerifyError{cmd.RelPath, fmt.Sprintf("%s checksum %s on target, %s sent", algorithm, sum, want)}
+			}
+			jww.DEBUG.Println("Verified ", algorithm, " checksum of ", cmd.RelPath)
+			return nil
+		}
+		if err != ErrChecksumUnsupported {
+			return err
+		}
+	}
+
+	if d, ok := target.(Downloader); ok && len(cmd.Contents) <= VerifyDownloadMax {
+		data, err := d.Download(cmd.RelPath)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, cmd.Contents) {
+			return &VerifyError{cmd.RelPath, "contents on target differ from those sent"}
+		}
+		jww.DEBUG.Println("Verified contents of ", cmd.RelPath)
+		return nil
+	}
+
+	if !checked {
+		jww.WARN.Println(target.GetName(), " can't verify uploads - ", cmd.RelPath, " not checked")
+	}
+	return nil
+}
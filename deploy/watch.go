@@ -0,0 +1,162 @@
+// Copyright © 2015 Philosopher Businessman abp@philosopherbusinessman.com
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deploy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/afero"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+//WatchKeepAlive is how often an idle connection is pinged while watching
+const WatchKeepAlive = 30 * time.Second
+
+//Watch deploys opts.SourceDir, then watches it and deploys again whenever it
+//changes, until ctx is cancelled. Changes are collected until nothing more
+//has happened for debounce, so a Hugo rebuild that writes many files is sent
+//as one deployment of the directory holding them all. The connection to the
+//target is kept open between deployments. A failed deployment is reported
+//and tried again with the next change. Only the operating system's
+//filesystem can be watched.
+func Watch(ctx context.Context, opts Options, debounce time.Duration) error {
+	if _, ok := osFsIfNil(opts.SourceFs).(*afero.OsFs); !ok {
+		return &Error{Op: OP_OPTIONS, Err: errors.New("only the operating system's filesystem can be watched")}
+	}
+	s, err := NewSession(opts)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return &Error{Op: OP_OPTIONS, Err: err}
+	}
+	defer w.Close()
+	if err := watchTree(w, opts.SourceDir); err != nil {
+		return &Error{Op: OP_SCAN, Err: err}
+	}
+
+	changed := make(map[string]bool) //Directories with changes in them
+	if err := s.Deploy(ctx, ""); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		jww.ERROR.Println(err, " - will try again on the next change")
+		changed[opts.SourceDir] = true
+	}
+	jww.FEEDBACK.Println("Watching ", opts.SourceDir, " for changes. Press Ctrl-C to stop")
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	keepAlive := time.NewTicker(WatchKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			jww.DEBUG.Println("Watch: ", ev)
+			if ev.Op&fsnotify.Create != 0 {
+				if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+					// Pick up a new directory and anything already written into it
+					if err := watchTree(w, ev.Name); err != nil {
+						jww.WARN.Println("Can't watch ", ev.Name, ": ", err)
+					}
+				}
+			}
+			changed[filepath.Dir(ev.Name)] = true
+			timer.Reset(debounce)
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			jww.WARN.Println("Watch error: ", err)
+
+		case <-timer.C:
+			relDir := commonDir(opts.SourceDir, changed)
+			changed = make(map[string]bool)
+			jww.FEEDBACK.Println("Changes found - deploying ", filepath.Join(opts.SourceDir, relDir))
+			if err := s.Deploy(ctx, relDir); err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				jww.ERROR.Println(err, " - will try again on the next change")
+				changed[filepath.Join(opts.SourceDir, relDir)] = true
+			}
+
+		case <-keepAlive.C:
+			s.KeepAlive()
+		}
+	}
+}
+
+//watchTree adds root and every directory below it to w, as fsnotify doesn't
+//watch subdirectories
+func watchTree(w *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed again while we were looking
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		return w.Add(path)
+	})
+}
+
+//commonDir finds the deepest directory, relative to root, holding all of dirs.
+//Directories outside root give root itself, as "".
+func commonDir(root string, dirs map[string]bool) string {
+	var common []string
+	first := true
+	for dir := range dirs {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return ""
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if first {
+			common, first = parts, false
+			continue
+		}
+		n := 0
+		for n < len(common) && n < len(parts) && common[n] == parts[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	return filepath.Join(common...)
+}